@@ -12,6 +12,12 @@ const ( // can be ORed
 	CommandAsUser = 2
 )
 
+const ( // which instances a command works on
+	TargetOne  = iota // a single instance id
+	TargetMany        // an instance id or a --selector
+	TargetAll         // every instance, filtered by an optional --selector
+)
+
 type CommandOption struct {
 	mandatory bool
 	value     any
@@ -20,12 +26,26 @@ type CommandOption struct {
 
 type Command struct {
 	run_as  int                      // privileges to run this command
+	lock    bool                     // holds the instance lock while running
+	audit   bool                     // recorded in the instance history
+	target  int                      // TargetOne unless set
+	bridged bool                     // sudo is mandatory anyway for instances on a host network, ie. not user
+	subs    map[string]int           // subcommands, eg. ql forward add, with their own target
+	args    int                      // positional arguments allowed after the instance id, -1 for any number
+	rest    bool                     // takes a command line after --
 	options map[string]CommandOption // option flags and defaults
 }
 
 type ParsedCommand struct { // result to the caller
 	cmd     string
+	sub     string
 	id      string
+	args    []string
+	rest    []string // after --, verbatim
+	lock    bool
+	audit   bool
+	target  int
+	bridged bool
 	options map[string]any
 }
 
@@ -34,6 +54,8 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 	cmds := map[string]Command{
 		"create": {
 			run_as: CommandAsUser,
+			lock:   true,
+			audit:  true,
 			options: map[string]CommandOption{
 				"--config": {
 					mandatory: true,
@@ -48,7 +70,11 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 			},
 		},
 		"start": {
-			run_as: CommandAsRoot,
+			run_as:  CommandAsRoot | CommandAsUser,
+			bridged: true,
+			lock:    true,
+			audit:   true,
+			target:  TargetMany,
 			options: map[string]CommandOption{
 				"--verbose": {
 					mandatory: false,
@@ -62,23 +88,126 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 			options: map[string]CommandOption{},
 		},
 		"stop": {
-			run_as:  CommandAsRoot,
+			run_as:  CommandAsRoot | CommandAsUser,
+			bridged: true,
+			lock:    true,
+			audit:   true,
+			target:  TargetMany,
 			options: map[string]CommandOption{},
 		},
 		"destroy": {
 			run_as:  CommandAsUser,
+			lock:    true,
+			audit:   true,
 			options: map[string]CommandOption{},
 		},
 		"protect": {
 			run_as:  CommandAsUser,
+			lock:    true,
+			audit:   true,
+			options: map[string]CommandOption{},
+		},
+		"list": {
+			run_as:  CommandAsRoot | CommandAsUser,
+			target:  TargetAll,
+			options: map[string]CommandOption{},
+		},
+		"inventory": {
+			run_as:  CommandAsRoot | CommandAsUser,
+			target:  TargetAll,
 			options: map[string]CommandOption{},
 		},
+		"serve": {
+			run_as: CommandAsRoot | CommandAsUser,
+			target: TargetAll,
+			options: map[string]CommandOption{
+				"--port": {
+					mandatory: false,
+					value:     nil,
+					dfault:    8111,
+				},
+			},
+		},
 		"status": {
 			run_as:  CommandAsRoot | CommandAsUser,
 			options: map[string]CommandOption{},
 		},
+		"balloon": {
+			run_as:  CommandAsRoot | CommandAsUser,
+			bridged: true,
+			lock:    true,
+			audit:   true,
+			options: map[string]CommandOption{
+				"--mem": {
+					mandatory: false,
+					value:     nil,
+					dfault:    0,
+				},
+				"--reclaim": {
+					mandatory: false,
+					value:     nil,
+					dfault:    false,
+				},
+			},
+		},
+		"history": {
+			run_as:  CommandAsRoot | CommandAsUser,
+			options: map[string]CommandOption{},
+		},
+		"forward": {
+			run_as: CommandAsRoot | CommandAsUser,
+			lock:   true,
+			audit:  true,
+			subs: map[string]int{
+				"add":  TargetOne,
+				"rm":   TargetOne,
+				"list": TargetAll,
+			},
+			args:    1,
+			options: map[string]CommandOption{},
+		},
+		"hosts": {
+			run_as: CommandAsRoot | CommandAsUser,
+			subs: map[string]int{
+				"sync": TargetAll,
+			},
+			options: map[string]CommandOption{},
+		},
+		"ssh-config": {
+			run_as:  CommandAsUser,
+			target:  TargetAll,
+			args:    -1,
+			options: map[string]CommandOption{},
+		},
+		"ssh": {
+			run_as: CommandAsUser,
+			target: TargetAll,
+			args:   -1,
+			rest:   true,
+			options: map[string]CommandOption{
+				"--tty": {
+					mandatory: false,
+					value:     nil,
+					dfault:    false,
+				},
+			},
+		},
+		"cp": {
+			run_as: CommandAsUser,
+			target: TargetAll,
+			args:   2,
+			options: map[string]CommandOption{
+				"--recursive": {
+					mandatory: false,
+					value:     nil,
+					dfault:    false,
+				},
+			},
+		},
 		"resize": {
 			run_as: CommandAsUser,
+			lock:   true,
+			audit:  true,
 			options: map[string]CommandOption{
 				"--size": {
 					mandatory: false,
@@ -89,7 +218,7 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 		},
 	}
 
-	if len(args) < 2 {
+	if len(args) < 1 {
 		return nil, fmt.Errorf("Not enough arguments")
 	}
 
@@ -103,6 +232,44 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 	}
 	cmd = cmds[argCmd] // command as a Command to get the related options
 
+	sub := ""
+	args = args[1:]
+	if cmd.subs != nil {
+		if len(args) < 1 {
+			return nil, fmt.Errorf("Missing subcommand for command %s", argCmd)
+		}
+		sub = args[0]
+		if cmd.target, ok = cmd.subs[sub]; !ok {
+			return nil, fmt.Errorf("Unknown subcommand [%s] for command [%s]", sub, argCmd)
+		}
+		args = args[1:]
+	}
+
+	rest := []string{}
+	if cmd.rest {
+		for i, arg := range args {
+			if arg == "--" {
+				rest = args[i+1:]
+				args = args[:i]
+				break
+			}
+		}
+	}
+
+	// options shared by every command
+	cmd.options["--wait-lock"] = CommandOption{
+		mandatory: false,
+		value:     nil,
+		dfault:    false,
+	}
+	if cmd.target != TargetOne {
+		cmd.options["--selector"] = CommandOption{
+			mandatory: false,
+			value:     nil,
+			dfault:    "",
+		}
+	}
+
 	currentUser, _ := user.Current()
 	if currentUser.Uid == "0" && cmd.run_as&CommandAsRoot != 1 {
 		return nil, fmt.Errorf("sudo is prohibited for command %s", argCmd)
@@ -111,13 +278,26 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 		return nil, fmt.Errorf("sudo is mandatory for command %s", argCmd)
 	}
 
-	id := args[1]                  // there's always an ID
-	for _, arg := range args[2:] { // Parse above cmd and id
+	id := ""
+	if cmd.target != TargetAll && len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		id = args[0]
+		args = args[1:]
+	}
+	if cmd.target == TargetOne && id == "" {
+		return nil, fmt.Errorf("Not enough arguments")
+	}
+
+	positional := []string{}
+	for _, arg := range args { // Parse above cmd and id, positional arguments and options may come in any order
+		if !strings.HasPrefix(arg, "--") && (cmd.args < 0 || len(positional) < cmd.args) {
+			positional = append(positional, arg)
+			continue
+		}
 		if !strings.HasPrefix(arg, "--") {
 			return nil, fmt.Errorf("option need to start with --")
 		}
 
-		splitted := strings.Split(arg, "=") // an option might be foo=bar
+		splitted := strings.SplitN(arg, "=", 2) // an option might be foo=bar, or foo=bar=baz for selectors
 		option_name := splitted[0]
 
 		var val CommandOption
@@ -165,9 +345,25 @@ func parseCommands(args []string) (*ParsedCommand, error) {
 		options[option_name] = opt.value
 	}
 
+	if cmd.target == TargetMany {
+		if id == "" && options["selector"] == "" {
+			return nil, fmt.Errorf("Missing instance id or --selector for command %s", argCmd)
+		}
+		if id != "" && options["selector"] != "" {
+			return nil, fmt.Errorf("Give either an instance id or --selector for command %s", argCmd)
+		}
+	}
+
 	return &ParsedCommand{
 		cmd:     argCmd,
+		sub:     sub,
 		id:      id,
+		args:    positional,
+		rest:    rest,
+		lock:    cmd.lock,
+		audit:   cmd.audit,
+		target:  cmd.target,
+		bridged: cmd.bridged,
 		options: options,
 	}, nil
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const gigabyte = 1024 * 1024 * 1024
+
+// ----------------------------------------------------------------------------
+// Balloon - query or change the memory left to the guest
+// mem == 0 and reclaim == false only shows the current balloon size
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) Balloon(mem int, reclaim bool) error {
+	if state, _ := inst.state(); state != Running && state != Paused {
+		return fmt.Errorf("Instance is not running")
+	}
+	if reclaim {
+		if inst.Config.MemMin == 0 {
+			return fmt.Errorf("No mem_min in instance config, nothing to reclaim to")
+		}
+		mem = inst.Config.MemMin
+	}
+	if mem != 0 {
+		floor := max(inst.Config.MemMin, 1)
+		if mem < floor || mem > inst.Config.Mem {
+			return fmt.Errorf("Memory must be between %dG and %dG", floor, inst.Config.Mem)
+		}
+	}
+
+	socket, opError := inst.openSocket()
+	if opError != nil {
+		return fmt.Errorf("Can't open monitor socket %v", opError)
+	}
+	defer socket.Close()
+
+	if mem != 0 {
+		cmd := fmt.Sprintf(`{ "execute": "balloon", "arguments": { "value": %d } }`, int64(mem)*gigabyte)
+		if _, err := qmpCmd(socket, cmd); err != nil {
+			return fmt.Errorf("Balloon failed : %w", err)
+		}
+	}
+
+	res, err := qmpCmd(socket, `{ "execute": "query-balloon" }`)
+	if err != nil {
+		return fmt.Errorf("Query balloon failed : %w", err)
+	}
+	var info struct {
+		Actual int64 `json:"actual"`
+	}
+	if err := json.Unmarshal(res, &info); err != nil {
+		return fmt.Errorf("Parsing JSON %w", err)
+	}
+	if mem != 0 {
+		fmt.Printf("Balloon target set to %dG\n", mem)
+	}
+	fmt.Printf("Guest memory : %.2fG of %dG\n", float64(info.Actual)/gigabyte, inst.Config.Mem)
+	return nil
+}
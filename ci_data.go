@@ -3,47 +3,49 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
 )
 
+var seedTemplates = []string{
+	"meta-data",
+	"network-config",
+	"user-data",
+	"vendor-data",
+}
+
 // ----------------------------------------------------------------------------
-// Build the Cloud Init ISO image
+// Build the Cloud Init seed, straight from the rendered templates :
+// an ISO image (cidata.iso) or a FAT disk (cidata.img), depending on seed_format
 // ----------------------------------------------------------------------------
 
 func (inst *Instance) mk_iso() error {
-	tmp := path.Join("tmp", "iso_data")
-	if err := os.RemoveAll(tmp); err != nil {
+	files, err := inst.renderSeed()
+	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(tmp, 0755); err != nil {
-		return err
+	var seed_file string
+	var seed []byte
+	switch inst.Config.SeedFormat {
+	case "vfat":
+		seed_file, seed = "cidata.img", buildFAT("cidata", files)
+	default:
+		seed_file, seed = "cidata.iso", buildISO("cidata", files)
 	}
-
-	iso_image := path.Join("tmp", "cidata.iso")
-	_ = os.Remove(iso_image)
-
-	template_files := []string{
-		"meta-data",
-		"network-config",
-		"user-data",
+	if err := os.WriteFile(path.Join(inst.Dir, seed_file), seed, 0644); err != nil {
+		return fmt.Errorf("Writing seed %w", err)
 	}
+	return nil
+}
 
-	for _, template_file := range template_files {
-		if err := inst.render_template(path.Join("templates", template_file), path.Join(tmp, template_file)); err != nil {
-			return err
+func (inst *Instance) renderSeed() ([]SeedFile, error) {
+	files := []SeedFile{}
+	for _, template_file := range seedTemplates {
+		data, err := inst.render(path.Join("templates", template_file))
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, SeedFile{Name: template_file, Data: data})
 	}
-
-	cmd := exec.Command("hdiutil", "makehybrid", "-ov", "-iso", "-joliet", "-default-volume-name", "cidata", "-o", "tmp/cidata.iso", "tmp/iso_data")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("Cmd hdutil failed with [%s] %w", string(out), err)
-	}
-
-	if _, err = file_cp("tmp/cidata.iso", path.Join(inst.Dir, "cidata.iso")); err != nil {
-		return fmt.Errorf("Copying iso %w", err)
-	}
-	return nil
+	return files, nil
 }
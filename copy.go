@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/term"
+)
+
+// ----------------------------------------------------------------------------
+// ql cp <src> <dst> - one of them is <id>:<path>, copied over SFTP through the
+// native SSH client. Remote relative paths start from the user's home
+// ----------------------------------------------------------------------------
+
+// The local or the guest side of a copy
+type copyFs interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Join(elem ...string) string
+}
+
+func Copy(args []string, recursive bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Expected a source and a destination, eg. ql cp ./file foobar:/tmp/")
+	}
+	src, dst := args[0], args[1]
+	src_id, src_path := splitCopyPath(src)
+	dst_id, dst_path := splitCopyPath(dst)
+	if (src_id == "") == (dst_id == "") {
+		return fmt.Errorf("Exactly one of %s and %s must be <id>:<path>", src, dst)
+	}
+	id := src_id + dst_id
+	inst, err := loadInstance(id)
+	if err != nil || !inst.exists() {
+		return fmt.Errorf("No instance %s", id)
+	}
+	if err := writeKnownHosts(); err != nil {
+		return err
+	}
+	client, err := inst.sshClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sftp_client, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return fmt.Errorf("Starting SFTP on %s : %w", id, err)
+	}
+	defer sftp_client.Close()
+
+	var src_fs, dst_fs copyFs = localFs{}, remoteFs{sftp_client}
+	if src_id != "" {
+		src_fs, dst_fs = dst_fs, src_fs
+	}
+
+	info, err := src_fs.Stat(src_path)
+	if err != nil {
+		return fmt.Errorf("Reading %s : %w", src, err)
+	}
+	if info.IsDir() && !recursive {
+		return fmt.Errorf("%s is a directory, use --recursive", src)
+	}
+	// As cp does : into an existing directory, under the source name
+	if dst_info, err := dst_fs.Stat(dst_path); err == nil && dst_info.IsDir() {
+		dst_path = dst_fs.Join(dst_path, path.Base(filepath.ToSlash(src_path)))
+	} else if strings.HasSuffix(dst_path, "/") {
+		return fmt.Errorf("Destination directory %s does not exist", dst)
+	}
+	return copyTree(src_fs, src_path, dst_fs, dst_path, info)
+}
+
+// scp's rule : a colon before any slash makes a remote path
+func splitCopyPath(arg string) (string, string) {
+	id, file, found := strings.Cut(arg, ":")
+	if !found || id == "" || strings.Contains(id, "/") {
+		return "", arg
+	}
+	if file == "" {
+		file = "."
+	}
+	return id, file
+}
+
+func copyTree(src_fs copyFs, src_path string, dst_fs copyFs, dst_path string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if err := dst_fs.Mkdir(dst_path); err != nil {
+			if existing, stat_err := dst_fs.Stat(dst_path); stat_err != nil || !existing.IsDir() {
+				return fmt.Errorf("Creating directory %s : %w", dst_path, err)
+			}
+		}
+		entries, err := src_fs.ReadDir(src_path)
+		if err != nil {
+			return fmt.Errorf("Reading directory %s : %w", src_path, err)
+		}
+		for _, entry := range entries {
+			child := src_fs.Join(src_path, entry.Name())
+			// Symbolic links are followed
+			child_info, err := src_fs.Stat(child)
+			if err != nil {
+				return fmt.Errorf("Reading %s : %w", child, err)
+			}
+			if err := copyTree(src_fs, child, dst_fs, dst_fs.Join(dst_path, entry.Name()), child_info); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := copyFile(src_fs, src_path, dst_fs, dst_path, info.Size()); err != nil {
+			return err
+		}
+	default:
+		fmt.Printf("Skipping %s, not a regular file\n", src_path)
+		return nil
+	}
+	if err := dst_fs.Chmod(dst_path, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("Setting permissions of %s : %w", dst_path, err)
+	}
+	return nil
+}
+
+func copyFile(src_fs copyFs, src_path string, dst_fs copyFs, dst_path string, size int64) error {
+	reader, err := src_fs.Open(src_path)
+	if err != nil {
+		return fmt.Errorf("Opening %s : %w", src_path, err)
+	}
+	defer reader.Close()
+	writer, err := dst_fs.Create(dst_path)
+	if err != nil {
+		return fmt.Errorf("Creating %s : %w", dst_path, err)
+	}
+	progress := &copyProgress{reader: reader, name: dst_path, size: size, live: term.IsTerminal(int(os.Stdout.Fd()))}
+	_, err = io.Copy(writer, progress)
+	if close_err := writer.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return fmt.Errorf("Copying %s to %s : %w", src_path, dst_path, err)
+	}
+	progress.done()
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Progress of a file, updated in place on a terminal
+// ----------------------------------------------------------------------------
+
+type copyProgress struct {
+	reader  io.Reader
+	name    string
+	size    int64
+	copied  int64
+	live    bool
+	printed time.Time
+}
+
+func (progress *copyProgress) Read(data []byte) (int, error) {
+	n, err := progress.reader.Read(data)
+	progress.copied += int64(n)
+	if progress.live && time.Since(progress.printed) > 200*time.Millisecond {
+		progress.printed = time.Now()
+		fmt.Printf("\r%s %s", progress.name, progress.status())
+	}
+	return n, err
+}
+
+// Lets SFTP uploads send concurrent writes
+func (progress *copyProgress) Size() int64 {
+	return progress.size
+}
+
+func (progress *copyProgress) done() {
+	if progress.live {
+		fmt.Print("\r")
+	}
+	fmt.Printf("%s %s\n", progress.name, progress.status())
+}
+
+func (progress *copyProgress) status() string {
+	percent := int64(100)
+	if progress.size > 0 {
+		percent = progress.copied * 100 / progress.size
+	}
+	return fmt.Sprintf("%3d%% %.1f MiB", percent, float64(progress.copied)/(1024*1024))
+}
+
+// ----------------------------------------------------------------------------
+// Both sides of a copy
+// ----------------------------------------------------------------------------
+
+type localFs struct{}
+
+func (localFs) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (localFs) Open(name string) (io.ReadCloser, error)    { return os.Open(name) }
+func (localFs) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (localFs) Mkdir(name string) error                    { return os.Mkdir(name, 0755) }
+func (localFs) Chmod(name string, mode os.FileMode) error  { return os.Chmod(name, mode) }
+func (localFs) Join(elem ...string) string                 { return filepath.Join(elem...) }
+
+func (localFs) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := []os.FileInfo{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+type remoteFs struct {
+	client *sftp.Client
+}
+
+func (fs remoteFs) Stat(name string) (os.FileInfo, error)      { return fs.client.Stat(name) }
+func (fs remoteFs) ReadDir(name string) ([]os.FileInfo, error) { return fs.client.ReadDir(name) }
+func (fs remoteFs) Open(name string) (io.ReadCloser, error)    { return fs.client.Open(name) }
+func (fs remoteFs) Create(name string) (io.WriteCloser, error) { return fs.client.Create(name) }
+func (fs remoteFs) Mkdir(name string) error                    { return fs.client.Mkdir(name) }
+func (fs remoteFs) Chmod(name string, mode os.FileMode) error  { return fs.client.Chmod(name, mode) }
+func (fs remoteFs) Join(elem ...string) string                 { return path.Join(elem...) }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// ----------------------------------------------------------------------------
+// A minimal FAT12 writer, enough for a Cloud Init seed disk :
+// - a single root directory holding a few small files, with VFAT long names
+// - the volume label cloud-init looks for
+// - fixed timestamps and a serial derived from the content, so the output is reproducible
+// ----------------------------------------------------------------------------
+
+const (
+	fatSectorSize  = 512
+	fatRootEntries = 224 // 14 sectors, as on a floppy
+	fatMinSectors  = 2880
+	fatMaxClusters = 4084 // above that, it is not FAT12 anymore
+	fatDate        = 0x0021
+)
+
+func buildFAT(label string, files []SeedFile) []byte {
+	sorted := append([]SeedFile{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	// Size the volume : at least a floppy, clusters grow until FAT12 can address everything
+	data_size := 0
+	for _, file := range sorted {
+		data_size += len(file.Data)
+	}
+	root_sectors := fatRootEntries * 32 / fatSectorSize
+	total := max(fatMinSectors, 1+root_sectors+2*16+2*data_size/fatSectorSize)
+	per_cluster := 1
+	for total/per_cluster > fatMaxClusters {
+		per_cluster *= 2
+	}
+	fat_sectors := 1
+	clusters := 0
+	for {
+		clusters = (total - 1 - root_sectors - 2*fat_sectors) / per_cluster
+		needed := ((clusters+2)*3/2 + fatSectorSize - 1) / fatSectorSize
+		if needed <= fat_sectors {
+			break
+		}
+		fat_sectors = needed
+	}
+
+	image := make([]byte, total*fatSectorSize)
+	fat_offset := fatSectorSize
+	root_offset := fat_offset + 2*fat_sectors*fatSectorSize
+	data_offset := root_offset + root_sectors*fatSectorSize
+	cluster_size := per_cluster * fatSectorSize
+
+	// Boot sector and BIOS parameter block
+	boot := image[:fatSectorSize]
+	copy(boot, []byte{0xEB, 0x3C, 0x90})
+	copy(boot[3:], "QLBIENNO")
+	binary.LittleEndian.PutUint16(boot[11:], fatSectorSize)
+	boot[13] = byte(per_cluster)
+	binary.LittleEndian.PutUint16(boot[14:], 1) // reserved sectors
+	boot[16] = 2                                // FAT copies
+	binary.LittleEndian.PutUint16(boot[17:], fatRootEntries)
+	binary.LittleEndian.PutUint16(boot[19:], uint16(total))
+	boot[21] = 0xF8 // fixed disk
+	binary.LittleEndian.PutUint16(boot[22:], uint16(fat_sectors))
+	binary.LittleEndian.PutUint16(boot[24:], 32) // sectors per track
+	binary.LittleEndian.PutUint16(boot[26:], 2)  // heads
+	boot[36] = 0x80
+	boot[38] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(boot[39:], fatSerial(sorted))
+	copy(boot[43:], fatPadded(label, 11))
+	copy(boot[54:], "FAT12   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	// Files data, one contiguous chain each
+	fat := make([]uint16, clusters+2)
+	fat[0], fat[1] = 0xFF8, 0xFFF
+	entries := [][]byte{fatLabelEntry(label)}
+	short_names := map[string]bool{}
+	next := 2
+	for _, file := range sorted {
+		first := 0
+		count := (len(file.Data) + cluster_size - 1) / cluster_size
+		if count > 0 {
+			first = next
+			for i := 0; i < count; i++ {
+				fat[next+i] = uint16(next + i + 1)
+			}
+			fat[next+count-1] = 0xFFF
+			copy(image[data_offset+(first-2)*cluster_size:], file.Data)
+			next += count
+		}
+		short := fatShortName(file.Name, short_names)
+		entries = append(entries, fatLongEntries(file.Name, short)...)
+		entries = append(entries, fatShortEntry(short, first, len(file.Data)))
+	}
+
+	// Both FAT copies, 12 bits per entry
+	for copy_index := 0; copy_index < 2; copy_index++ {
+		table := image[fat_offset+copy_index*fat_sectors*fatSectorSize:]
+		for i, value := range fat {
+			offset := i * 3 / 2
+			if i%2 == 0 {
+				table[offset] = byte(value)
+				table[offset+1] = table[offset+1]&0xF0 | byte(value>>8)&0x0F
+			} else {
+				table[offset] = table[offset]&0x0F | byte(value<<4)
+				table[offset+1] = byte(value >> 4)
+			}
+		}
+	}
+
+	for i, entry := range entries {
+		copy(image[root_offset+i*32:], entry)
+	}
+	return image
+}
+
+// Volume serial number, derived from the content rather than the clock
+func fatSerial(files []SeedFile) uint32 {
+	hash := crc32.NewIEEE()
+	for _, file := range files {
+		hash.Write([]byte(file.Name))
+		hash.Write(file.Data)
+	}
+	return hash.Sum32()
+}
+
+func fatPadded(value string, size int) []byte {
+	return []byte(fmt.Sprintf("%-*s", size, strings.ToUpper(value))[:size])
+}
+
+// ----------------------------------------------------------------------------
+// Root directory entries
+// ----------------------------------------------------------------------------
+
+func fatLabelEntry(label string) []byte {
+	entry := make([]byte, 32)
+	copy(entry, fatPadded(label, 11))
+	entry[11] = 0x08 // volume label
+	binary.LittleEndian.PutUint16(entry[24:], fatDate)
+	return entry
+}
+
+func fatShortEntry(short string, first int, size int) []byte {
+	entry := make([]byte, 32)
+	copy(entry, short)
+	entry[11] = 0x20                                   // archive
+	binary.LittleEndian.PutUint16(entry[16:], fatDate) // created
+	binary.LittleEndian.PutUint16(entry[18:], fatDate) // accessed
+	binary.LittleEndian.PutUint16(entry[24:], fatDate) // modified
+	binary.LittleEndian.PutUint16(entry[26:], uint16(first))
+	binary.LittleEndian.PutUint32(entry[28:], uint32(size))
+	return entry
+}
+
+// 8.3 name as stored on disk (11 bytes, no dot), made unique with a ~N tail
+func fatShortName(name string, taken map[string]bool) string {
+	clean := func(value string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+				return r
+			}
+			return -1
+		}, value)
+	}
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot > 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		short := base
+		if len(short)+len(tail) > 8 {
+			short = short[:8-len(tail)]
+		}
+		short = fmt.Sprintf("%-8s%-3s", short+tail, ext)
+		if !taken[short] {
+			taken[short] = true
+			return short
+		}
+	}
+}
+
+// VFAT long name entries, last part first as they appear on disk
+func fatLongEntries(name string, short string) [][]byte {
+	var checksum byte
+	for i := 0; i < 11; i++ {
+		checksum = (checksum&1)<<7 + checksum>>1 + short[i]
+	}
+
+	units := utf16.Encode([]rune(name))
+	count := (len(units) + 12) / 13
+	if len(units)%13 != 0 {
+		units = append(units, 0)
+	}
+	for len(units) < count*13 {
+		units = append(units, 0xFFFF)
+	}
+
+	entries := [][]byte{}
+	for part := count; part >= 1; part-- {
+		entry := make([]byte, 32)
+		entry[0] = byte(part)
+		if part == count {
+			entry[0] |= 0x40
+		}
+		entry[11] = 0x0F // long name
+		entry[13] = checksum
+		chunk := units[(part-1)*13 : part*13]
+		for i, unit := range chunk {
+			var offset int
+			switch {
+			case i < 5:
+				offset = 1 + 2*i
+			case i < 11:
+				offset = 14 + 2*(i-5)
+			default:
+				offset = 28 + 2*(i-11)
+			}
+			binary.LittleEndian.PutUint16(entry[offset:], unit)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
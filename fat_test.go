@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+type fatTestVolume struct {
+	image        []byte
+	per_cluster  int
+	fat_sectors  int
+	root_offset  int
+	data_offset  int
+	cluster_size int
+}
+
+type fatTestFile struct {
+	long_name string
+	short     []byte
+	first     int
+	size      int
+}
+
+func parseFatVolume(t *testing.T, image []byte) fatTestVolume {
+	t.Helper()
+	boot := image[:fatSectorSize]
+	if boot[510] != 0x55 || boot[511] != 0xAA || string(boot[54:62]) != "FAT12   " {
+		t.Fatalf("No FAT12 boot sector")
+	}
+	if sector_size := binary.LittleEndian.Uint16(boot[11:]); sector_size != fatSectorSize {
+		t.Fatalf("Sector size %d", sector_size)
+	}
+	if total := binary.LittleEndian.Uint16(boot[19:]); int(total)*fatSectorSize != len(image) {
+		t.Fatalf("Boot sector says %d sectors, image has %d bytes", total, len(image))
+	}
+	if boot[16] != 2 || binary.LittleEndian.Uint16(boot[17:]) != fatRootEntries {
+		t.Fatalf("Expected 2 FATs and %d root entries", fatRootEntries)
+	}
+	volume := fatTestVolume{
+		image:       image,
+		per_cluster: int(boot[13]),
+		fat_sectors: int(binary.LittleEndian.Uint16(boot[22:])),
+	}
+	reserved := int(binary.LittleEndian.Uint16(boot[14:]))
+	volume.root_offset = (reserved + 2*volume.fat_sectors) * fatSectorSize
+	volume.data_offset = volume.root_offset + fatRootEntries*32
+	volume.cluster_size = volume.per_cluster * fatSectorSize
+	return volume
+}
+
+func (volume fatTestVolume) fatEntry(copy_index int, cluster int) int {
+	table := volume.image[(1+copy_index*volume.fat_sectors)*fatSectorSize:]
+	value := int(binary.LittleEndian.Uint16(table[cluster*3/2:]))
+	if cluster%2 == 1 {
+		return value >> 4
+	}
+	return value & 0xFFF
+}
+
+// The content of a file, following its cluster chain in the first FAT
+func (volume fatTestVolume) readChain(t *testing.T, file fatTestFile) []byte {
+	t.Helper()
+	data := []byte{}
+	seen := map[int]bool{}
+	for cluster := file.first; cluster != 0 && cluster < 0xFF8; cluster = volume.fatEntry(0, cluster) {
+		if cluster < 2 || seen[cluster] {
+			t.Fatalf("%s has a broken chain at cluster %d", file.long_name, cluster)
+		}
+		seen[cluster] = true
+		offset := volume.data_offset + (cluster-2)*volume.cluster_size
+		data = append(data, volume.image[offset:offset+volume.cluster_size]...)
+	}
+	if expected := (file.size + volume.cluster_size - 1) / volume.cluster_size; len(seen) != expected {
+		t.Fatalf("%s has %d clusters, expected %d", file.long_name, len(seen), expected)
+	}
+	return data[:file.size]
+}
+
+// The label entry and files of the root directory, long names checked against their short entry
+func (volume fatTestVolume) rootEntries(t *testing.T) (string, []fatTestFile) {
+	t.Helper()
+	label := ""
+	files := []fatTestFile{}
+	var long_units []uint16
+	var long_checksum byte
+	expected_ordinal := 0
+	for i := 0; i < fatRootEntries; i++ {
+		entry := volume.image[volume.root_offset+i*32 : volume.root_offset+(i+1)*32]
+		if entry[0] == 0 {
+			break
+		}
+		switch entry[11] {
+		case 0x08:
+			label = string(entry[:11])
+		case 0x0F:
+			ordinal := int(entry[0] &^ 0x40)
+			if entry[0]&0x40 != 0 {
+				long_units, long_checksum, expected_ordinal = nil, entry[13], ordinal
+			} else if expected_ordinal == 0 || entry[13] != long_checksum {
+				t.Fatalf("Long name entry %d is out of sequence", i)
+			}
+			if ordinal != expected_ordinal {
+				t.Fatalf("Long name entry %d has ordinal %d, expected %d", i, ordinal, expected_ordinal)
+			}
+			expected_ordinal--
+			part := []uint16{}
+			for _, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part = append(part, binary.LittleEndian.Uint16(entry[offset:]))
+			}
+			long_units = append(part, long_units...)
+		default:
+			if long_units == nil || expected_ordinal != 0 {
+				t.Fatalf("Short entry %q has no complete long name", entry[:11])
+			}
+			// Rotate right then add, as the VFAT specification spells it
+			var checksum byte
+			for _, c := range entry[:11] {
+				checksum = (checksum>>1 | checksum<<7) + c
+			}
+			if checksum != long_checksum {
+				t.Errorf("Long name checksum %#x, short entry %q gives %#x", long_checksum, entry[:11], checksum)
+			}
+			if end := slices.Index(long_units, 0); end >= 0 {
+				long_units = long_units[:end]
+			}
+			files = append(files, fatTestFile{
+				long_name: string(utf16.Decode(long_units)),
+				short:     entry[:11],
+				first:     int(binary.LittleEndian.Uint16(entry[26:])),
+				size:      int(binary.LittleEndian.Uint32(entry[28:])),
+			})
+			long_units = nil
+		}
+	}
+	return label, files
+}
+
+func TestBuildFATIsReproducible(t *testing.T) {
+	files := testSeedFiles()
+	first := buildFAT("cidata", files)
+	reversed := []SeedFile{}
+	for i := len(files) - 1; i >= 0; i-- {
+		reversed = append(reversed, files[i])
+	}
+	if !bytes.Equal(first, buildFAT("cidata", reversed)) {
+		t.Fatal("Two builds of the same seed differ")
+	}
+	if len(first) != fatMinSectors*fatSectorSize {
+		t.Errorf("A small seed takes %d bytes, expected a floppy", len(first))
+	}
+}
+
+func TestBuildFATLabel(t *testing.T) {
+	volume := parseFatVolume(t, buildFAT("cidata", testSeedFiles()))
+	if boot_label := string(volume.image[43:54]); boot_label != "CIDATA     " {
+		t.Errorf("Boot sector label %q", boot_label)
+	}
+	if label, _ := volume.rootEntries(t); label != "CIDATA     " {
+		t.Errorf("Root directory label %q", label)
+	}
+}
+
+func TestBuildFATFiles(t *testing.T) {
+	small := testSeedFiles()
+	// Large enough for clusters of several sectors
+	large := append(testSeedFiles(), SeedFile{Name: "a-rather-long-file-name.txt", Data: bytes.Repeat([]byte("0123456789abcdef"), 256*1024)})
+
+	for _, files := range [][]SeedFile{small, large} {
+		volume := parseFatVolume(t, buildFAT("cidata", files))
+		if len(files) == len(large) && volume.per_cluster == 1 {
+			t.Errorf("A %d MiB seed still uses single sector clusters", len(large[len(large)-1].Data)/(1024*1024))
+		}
+
+		fat_size := volume.fat_sectors * fatSectorSize
+		fat_start := fatSectorSize
+		if !bytes.Equal(volume.image[fat_start:fat_start+fat_size], volume.image[fat_start+fat_size:fat_start+2*fat_size]) {
+			t.Errorf("The two FAT copies differ")
+		}
+		if volume.fatEntry(0, 0) != 0xFF8 || volume.fatEntry(0, 1) != 0xFFF {
+			t.Errorf("Reserved FAT entries %#x %#x", volume.fatEntry(0, 0), volume.fatEntry(0, 1))
+		}
+
+		_, entries := volume.rootEntries(t)
+		if len(entries) != len(files) {
+			t.Fatalf("Root directory has %d files, expected %d", len(entries), len(files))
+		}
+		by_name := map[string][]byte{}
+		for _, file := range files {
+			by_name[file.Name] = file.Data
+		}
+		shorts := map[string]bool{}
+		for _, entry := range entries {
+			data, found := by_name[entry.long_name]
+			if !found {
+				t.Errorf("Unexpected file %q", entry.long_name)
+				continue
+			}
+			if shorts[string(entry.short)] {
+				t.Errorf("Short name %q is used twice", entry.short)
+			}
+			shorts[string(entry.short)] = true
+			if strings.ToUpper(string(entry.short)) != string(entry.short) {
+				t.Errorf("Short name %q is not upper case", entry.short)
+			}
+			if entry.size != len(data) {
+				t.Errorf("%s has size %d, expected %d", entry.long_name, entry.size, len(data))
+			}
+			if len(data) == 0 {
+				if entry.first != 0 {
+					t.Errorf("Empty %s starts at cluster %d", entry.long_name, entry.first)
+				}
+				continue
+			}
+			if !bytes.Equal(volume.readChain(t, entry), data) {
+				t.Errorf("%s content differs", entry.long_name)
+			}
+		}
+	}
+}
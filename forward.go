@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ----------------------------------------------------------------------------
+// Host port forwards of user mode instances, [tcp:|udp:]host_port:guest_port
+// Saved in the instance config, so boot.sh gets them on the next start
+// ----------------------------------------------------------------------------
+
+type PortForward struct {
+	Proto     string
+	HostPort  int
+	GuestPort int
+}
+
+func parseForward(rule string) (PortForward, error) {
+	parts := strings.Split(rule, ":")
+	forward := PortForward{Proto: "tcp"}
+	if len(parts) == 3 {
+		forward.Proto, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 2 || (forward.Proto != "tcp" && forward.Proto != "udp") {
+		return forward, fmt.Errorf("Invalid forward %s, expected [tcp:|udp:]host_port:guest_port", rule)
+	}
+	var err error
+	for i, port := range []*int{&forward.HostPort, &forward.GuestPort} {
+		if *port, err = strconv.Atoi(parts[i]); err != nil || *port <= 0 || *port > 65535 {
+			return forward, fmt.Errorf("Invalid port %s in forward %s", parts[i], rule)
+		}
+	}
+	return forward, nil
+}
+
+// The rule as saved in config.yaml, tcp being implied
+func (forward PortForward) String() string {
+	rule := fmt.Sprintf("%d:%d", forward.HostPort, forward.GuestPort)
+	if forward.Proto != "tcp" {
+		rule = forward.Proto + ":" + rule
+	}
+	return rule
+}
+
+// The qemu hostfwd rule, listening on the host loopback only as for SSH
+func (forward PortForward) Hostfwd() string {
+	return fmt.Sprintf("%s:127.0.0.1:%d-:%d", forward.Proto, forward.HostPort, forward.GuestPort)
+}
+
+func isForwardRule(fl validator.FieldLevel) bool {
+	_, err := parseForward(fl.Field().String())
+	return err == nil
+}
+
+// Forwards of the instance, for boot.sh - rules were checked when loading the config
+func (inst *Instance) Forwards() []PortForward {
+	forwards := []PortForward{}
+	for _, rule := range inst.Config.Forwards {
+		if forward, err := parseForward(rule); err == nil {
+			forwards = append(forwards, forward)
+		}
+	}
+	return forwards
+}
+
+// ----------------------------------------------------------------------------
+// ql forward add|rm <id> <rule> - applied right away through QMP when running
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) Forward(sub string, args []string) error {
+	if inst.Config.Network != "user" {
+		return fmt.Errorf("Port forwarding needs network: user, other networks reach the guest directly")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("Missing forward rule, eg. ql forward %s %s 8080:80", sub, inst.ID)
+	}
+	switch sub {
+	case "add":
+		return inst.addForward(args[0])
+	case "rm":
+		return inst.removeForward(args[0])
+	}
+	return fmt.Errorf("Unknown subcommand [%s] for command [forward]", sub)
+}
+
+func (inst *Instance) addForward(rule string) error {
+	forward, err := parseForward(rule)
+	if err != nil {
+		return err
+	}
+
+	// Host ports are shared by every instance, and by SSH
+	lock, err := lockResource("network")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	others, err := otherConfigs(inst.ID)
+	if err != nil {
+		return err
+	}
+	for _, conf := range append(others, inst.Config) {
+		if forward.Proto == "tcp" && conf.Network == "user" && conf.SshPort == forward.HostPort {
+			return fmt.Errorf("Host port %d is already used for SSH", forward.HostPort)
+		}
+		for _, other_rule := range conf.Forwards {
+			other, _ := parseForward(other_rule)
+			if other.Proto == forward.Proto && other.HostPort == forward.HostPort {
+				return fmt.Errorf("Host port %s:%d is already forwarded", forward.Proto, forward.HostPort)
+			}
+		}
+	}
+
+	if state, _ := inst.state(); state == Running || state == Paused {
+		if err := inst.monitorCmd("hostfwd_add net0 " + forward.Hostfwd()); err != nil {
+			return fmt.Errorf("Adding forward %s failed : %w", forward, err)
+		}
+	}
+	inst.Config.Forwards = append(inst.Config.Forwards, forward.String())
+	if err := inst.saveConfig(); err != nil {
+		return err
+	}
+	fmt.Printf("127.0.0.1:%d (%s) forwarded to port %d of %s\n", forward.HostPort, forward.Proto, forward.GuestPort, inst.ID)
+	return nil
+}
+
+// The rule may be given in full or as [proto:]host_port
+func (inst *Instance) removeForward(rule string) error {
+	proto, port := "tcp", rule
+	if forward, err := parseForward(rule); err == nil {
+		proto, port = forward.Proto, strconv.Itoa(forward.HostPort)
+	} else if before, after, found := strings.Cut(rule, ":"); found {
+		proto, port = before, after
+	}
+
+	kept := []string{}
+	var removed *PortForward
+	for _, existing := range inst.Forwards() {
+		if removed == nil && existing.Proto == proto && strconv.Itoa(existing.HostPort) == port {
+			removed = &existing
+			continue
+		}
+		kept = append(kept, existing.String())
+	}
+	if removed == nil {
+		return fmt.Errorf("No forward from host port %s:%s", proto, port)
+	}
+
+	if state, _ := inst.state(); state == Running || state == Paused {
+		if err := inst.monitorCmd(fmt.Sprintf("hostfwd_remove net0 %s:127.0.0.1:%d", removed.Proto, removed.HostPort)); err != nil {
+			return fmt.Errorf("Removing forward %s failed : %w", removed, err)
+		}
+	}
+	inst.Config.Forwards = kept
+	if err := inst.saveConfig(); err != nil {
+		return err
+	}
+	fmt.Printf("Forward %s removed\n", removed)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// ql forward list - every forward of the selected instances
+// ----------------------------------------------------------------------------
+
+func ListForwards(selector string) error {
+	insts, err := selectInstances(selector)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s %-6s %-21s %s\n", "ID", "PROTO", "HOST", "GUEST PORT")
+	for _, inst := range insts {
+		for _, forward := range inst.Forwards() {
+			fmt.Printf("%-16s %-6s %-21s %d\n", inst.ID, forward.Proto, fmt.Sprintf("127.0.0.1:%d", forward.HostPort), forward.GuestPort)
+		}
+	}
+	return nil
+}
+
+// A human monitor command through QMP, its output is only there on failure
+func (inst *Instance) monitorCmd(command_line string) error {
+	socket, opError := inst.openSocket()
+	if opError != nil {
+		return fmt.Errorf("Can't open monitor socket %v", opError)
+	}
+	defer socket.Close()
+
+	args, _ := json.Marshal(map[string]string{"command-line": command_line})
+	res, err := qmpCmd(socket, fmt.Sprintf(`{ "execute": "human-monitor-command", "arguments": %s }`, args))
+	if err != nil {
+		return err
+	}
+	var output string
+	if err := json.Unmarshal(res, &output); err != nil {
+		return fmt.Errorf("Parsing JSON %w", err)
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s", output)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type HistoryEntry struct {
+	Time       time.Time      `json:"time"`
+	Command    string         `json:"command"`
+	Args       []string       `json:"args,omitempty"`
+	HostUser   string         `json:"host_user"`
+	Euid       int            `json:"euid"`
+	Options    map[string]any `json:"options"`
+	Result     string         `json:"result"`
+	DurationMs int64          `json:"duration_ms"`
+}
+
+// ----------------------------------------------------------------------------
+// Append a lifecycle operation to instances/<id>/history.jsonl
+// Nothing is recorded when the instance folder is gone (destroyed, or create failed)
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) recordHistory(parsed *ParsedCommand, cmdErr error, duration time.Duration) error {
+	if !inst.exists() {
+		return nil
+	}
+	command := parsed.cmd
+	if parsed.sub != "" {
+		command += " " + parsed.sub
+	}
+	entry := HistoryEntry{
+		Time:       time.Now().UTC(),
+		Command:    command,
+		Args:       parsed.args,
+		HostUser:   hostUser(),
+		Euid:       os.Geteuid(),
+		Options:    parsed.options,
+		Result:     "ok",
+		DurationMs: duration.Milliseconds(),
+	}
+	if cmdErr != nil {
+		entry.Result = cmdErr.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	history_file := path.Join(inst.Dir, "history.jsonl")
+	file, err := os.OpenFile(history_file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Opening history %s : %w", history_file, err)
+	}
+	defer file.Close()
+	// Written both with and without sudo : owned by the instance user, but only writable by it
+	// Files from older versions were world writable
+	_ = file.Chmod(0644)
+	file_chown_to(file, inst.Config.HostUser)
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// ----------------------------------------------------------------------------
+// Show the instance history, oldest first
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) History() error {
+	history_file := path.Join(inst.Dir, "history.jsonl")
+	file, err := os.Open(history_file)
+	if os.IsNotExist(err) {
+		fmt.Println("No history yet")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("Parsing history %s : %w", history_file, err)
+		}
+		who := entry.HostUser
+		if entry.Euid == 0 {
+			who += " (sudo)"
+		}
+		duration := time.Duration(entry.DurationMs) * time.Millisecond
+		command := strings.Join(append([]string{entry.Command}, entry.Args...), " ")
+		fmt.Printf("%s  %-8s %-16s %-8s %s  %s\n",
+			entry.Time.Local().Format("2006-01-02 15:04:05"), command, who, duration, formatOptions(entry.Options), entry.Result)
+	}
+	return scanner.Err()
+}
+
+// The user behind the command, even when run through sudo
+func hostUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+	if currentUser, err := user.Current(); err == nil {
+		return currentUser.Username
+	}
+	return "unknown"
+}
+
+func formatOptions(options map[string]any) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("%s=%v", name, options[name]))
+	}
+	return "[" + strings.Join(formatted, " ") + "]"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// What the host machine gives us to run qemu, filled by detect() in host_<os>.go
+type Host struct {
+	OS       string // runtime.GOOS
+	Arch     string // qemu flavour of the arch, eg. aarch64
+	Accel    string // hvf, kvm or tcg
+	Machine  string // qemu -M
+	Cpu      string // qemu -cpu
+	Firmware string // UEFI firmware, copied to bios.fd at creation
+}
+
+type HostRequirement struct {
+	names []string // any of them will do
+	file  bool     // a file to be found rather than an executable in PATH
+}
+
+var currentHost *Host
+
+// ----------------------------------------------------------------------------
+// The host we're running on, detected once
+// ----------------------------------------------------------------------------
+
+func getHost() *Host {
+	if currentHost == nil {
+		currentHost = &Host{
+			OS:   runtime.GOOS,
+			Arch: qemuArch(),
+		}
+		currentHost.detect()
+	}
+	return currentHost
+}
+
+func (host *Host) checkRequirements() {
+	for _, req := range host.requirements() {
+		if firstFound(req) == "" {
+			if req.file {
+				fatalf("Missing file %v", req.names)
+			}
+			fatalf("Executable %v not found in PATH", req.names)
+		}
+	}
+}
+
+// First file or executable of the requirement found on the host, or ""
+func firstFound(req HostRequirement) string {
+	for _, name := range req.names {
+		if req.file {
+			if file_exists(name) {
+				return name
+			}
+		} else if path, _ := exec.LookPath(name); len(path) > 0 {
+			return path
+		}
+	}
+	return ""
+}
+
+func (host *Host) machine() string {
+	if host.Arch == "x86_64" {
+		return "q35"
+	}
+	return "virt"
+}
+
+func (host *Host) qemuBinary() string {
+	return fmt.Sprintf("qemu-system-%s", host.Arch)
+}
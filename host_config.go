@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v3"
+)
+
+const hostConfigFile = "ql.yaml"
+
+// ----------------------------------------------------------------------------
+// Host level settings, shared by every instance, read from ./ql.yaml if present
+// ----------------------------------------------------------------------------
+
+type HostConfig struct {
+	IpPool          *IpPool                   `yaml:"ip_pool" validate:"omitempty"`
+	PrivateNetworks map[string]PrivateNetwork `yaml:"private_networks" validate:"dive"`
+	HostsFile       string                    `yaml:"hosts_file"` // managed by ql hosts sync, /etc/hosts when not set
+}
+
+type PrivateNetwork struct {
+	Subnet string `validate:"required,cidrv4"` // addresses given to the instances joining it
+}
+
+type IpPool struct {
+	Subnet string `validate:"required,cidrv4"`
+	Range  string `validate:"required"` // .70-.99 or 192.168.1.70-192.168.1.99
+}
+
+func loadHostConfig() (*HostConfig, error) {
+	conf := &HostConfig{}
+	if !file_exists(hostConfigFile) {
+		return conf, nil
+	}
+	data, err := os.ReadFile(hostConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("Reading config file %s : %s", hostConfigFile, err)
+	}
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("Parsing yaml file %s : %s", hostConfigFile, err)
+	}
+	var validate = validator.New(validator.WithRequiredStructEnabled())
+	if err := validate.Struct(conf); err != nil {
+		return nil, fmt.Errorf("Validating config file %s : %s", hostConfigFile, err)
+	}
+	return conf, nil
+}
+
+// Every address of the range, in order, checked against the subnet
+func (pool *IpPool) addresses() ([]string, error) {
+	_, subnet, err := net.ParseCIDR(pool.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ip_pool subnet %s : %w", pool.Subnet, err)
+	}
+	bounds := strings.SplitN(pool.Range, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Invalid ip_pool range %s, expected first-last", pool.Range)
+	}
+	first, err := poolAddress(subnet, bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	last, err := poolAddress(subnet, bounds[1])
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for ip := first; ip <= last; ip++ {
+		addresses = append(addresses, net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String())
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("Empty ip_pool range %s", pool.Range)
+	}
+	return addresses, nil
+}
+
+// Prefix length of the pool subnet, given to the addresses picked from it
+func (pool *IpPool) prefix() string {
+	_, length, _ := strings.Cut(pool.Subnet, "/")
+	return length
+}
+
+// A range bound, either a full address or .N for the last byte within the subnet
+func poolAddress(subnet *net.IPNet, bound string) (uint32, error) {
+	bound = strings.TrimSpace(bound)
+	base := subnet.IP.To4()
+	var ip net.IP
+	if strings.HasPrefix(bound, ".") {
+		last, err := strconv.Atoi(bound[1:])
+		if err != nil || last < 0 || last > 255 {
+			return 0, fmt.Errorf("Invalid ip_pool bound %s", bound)
+		}
+		ip = net.IPv4(base[0], base[1], base[2], byte(last)).To4()
+	} else {
+		ip = net.ParseIP(bound).To4()
+		if ip == nil {
+			return 0, fmt.Errorf("Invalid ip_pool bound %s", bound)
+		}
+	}
+	if !subnet.Contains(ip) {
+		return 0, fmt.Errorf("ip_pool bound %s is outside %s", ip, subnet)
+	}
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// ----------------------------------------------------------------------------
+// macOS : Hypervisor.framework and vmnet networking
+// ----------------------------------------------------------------------------
+
+func (host *Host) detect() {
+	host.Accel = "hvf"
+	host.Machine = host.machine()
+	host.Cpu = "host"
+	host.Firmware = firstFound(host.firmwares())
+}
+
+func (host *Host) firmwares() HostRequirement {
+	return HostRequirement{
+		names: []string{
+			fmt.Sprintf("/opt/local/share/qemu/edk2-%s-code.fd", host.Arch),    // MacPorts
+			fmt.Sprintf("/opt/homebrew/share/qemu/edk2-%s-code.fd", host.Arch), // Homebrew
+			fmt.Sprintf("/usr/local/share/qemu/edk2-%s-code.fd", host.Arch),    // Homebrew on Intel
+		},
+		file: true,
+	}
+}
+
+func (host *Host) requirements() []HostRequirement {
+	return []HostRequirement{
+		{names: []string{host.qemuBinary()}},
+		{names: []string{"qemu-img"}},
+		{names: []string{"route"}},
+		{names: []string{"awk"}},
+		host.firmwares(),
+	}
+}
+
+// DHCP leases of vmnet shared and host networks, then the ARP cache
+func (host *Host) discoverIP(mac string, _ string) string {
+	if ip := leaseFromBootpd("/var/db/dhcpd_leases", mac); ip != "" {
+		return ip
+	}
+	out, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return ""
+	}
+	return leaseFromARP(string(out), mac)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// ----------------------------------------------------------------------------
+// Linux : KVM when /dev/kvm is usable, TCG otherwise, and bridge networking
+// ----------------------------------------------------------------------------
+
+func (host *Host) detect() {
+	host.Machine = host.machine()
+	if kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err == nil {
+		kvm.Close()
+		host.Accel = "kvm"
+		host.Cpu = "host"
+	} else {
+		host.Accel = "tcg"
+		host.Cpu = "max"
+	}
+	host.Firmware = firstFound(host.firmwares())
+}
+
+func (host *Host) firmwares() HostRequirement {
+	names := []string{fmt.Sprintf("/usr/share/qemu/edk2-%s-code.fd", host.Arch)}
+	if host.Arch == "x86_64" {
+		names = append(names,
+			"/usr/share/ovmf/OVMF.fd", // Debian, Ubuntu
+			"/usr/share/qemu/OVMF.fd", // Arch, openSUSE
+		)
+	} else {
+		names = append(names,
+			"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd", // Debian, Ubuntu
+			"/usr/share/edk2/aarch64/QEMU_EFI.fd",     // Fedora
+		)
+	}
+	return HostRequirement{names: names, file: true}
+}
+
+func (host *Host) requirements() []HostRequirement {
+	return []HostRequirement{
+		{names: []string{host.qemuBinary()}},
+		{names: []string{"qemu-img"}},
+		host.firmwares(),
+	}
+}
+
+// DHCP leases of libvirt or a plain dnsmasq serving the bridge, then the ARP cache
+func (host *Host) discoverIP(mac string, bridge string) string {
+	if ip := leaseFromLibvirt(path.Join("/var/lib/libvirt/dnsmasq", bridge+".status"), mac); ip != "" {
+		return ip
+	}
+	if ip := leaseFromDnsmasq("/var/lib/misc/dnsmasq.leases", mac); ip != "" {
+		return ip
+	}
+	arp, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	return leaseFromARP(string(arp), mac)
+}
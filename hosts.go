@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var hostLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+const (
+	hostsDomain     = ".ql"
+	hostsBlockBegin = "# BEGIN ql-bienno, managed by ql hosts sync"
+	hostsBlockEnd   = "# END ql-bienno"
+)
+
+// ----------------------------------------------------------------------------
+// Name resolution from the host : a managed block in /etc/hosts (or hosts_file
+// from ql.yaml) maps <id>.ql and <label value>.ql to the instance address
+// ----------------------------------------------------------------------------
+
+func SyncHosts(selector string) error {
+	if selector != "" {
+		return fmt.Errorf("ql hosts sync always covers every instance, no --selector")
+	}
+	lock, err := lockResource("hosts")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	hosts_file, err := hostsFile()
+	if err != nil {
+		return err
+	}
+	lines, err := hostsLines()
+	if err != nil {
+		return err
+	}
+	if err := writeHostsBlock(hosts_file, lines); err != nil {
+		return err
+	}
+	fmt.Printf("%d instance(s) written to %s\n", len(lines), hosts_file)
+	return nil
+}
+
+// After a create or destroy, only once the block was written by ql hosts sync
+func refreshHosts() {
+	hosts_file, err := hostsFile()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(hosts_file)
+	if err != nil || !strings.Contains(string(data), hostsBlockBegin) {
+		return
+	}
+	if err := SyncHosts(""); err != nil {
+		fmt.Printf("%s is not up to date (%s), run sudo ./ql hosts sync\n", hosts_file, err)
+	}
+}
+
+func hostsFile() (string, error) {
+	host_config, err := loadHostConfig()
+	if err != nil {
+		return "", err
+	}
+	if host_config.HostsFile != "" {
+		return host_config.HostsFile, nil
+	}
+	return "/etc/hosts", nil
+}
+
+// One line per instance with a known address, user mode ones are only reachable through 127.0.0.1
+func hostsLines() ([]string, error) {
+	insts, err := selectInstances("")
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, inst := range insts {
+		if inst.Config.Network == "user" {
+			continue
+		}
+		// Lease files and the address file are not trusted to hold an address
+		address := inst.guestIP()
+		if net.ParseIP(address) == nil {
+			continue
+		}
+		if !validHostName(inst.ID) {
+			fmt.Printf("Skipping %s, not a valid host name\n", inst.ID)
+			continue
+		}
+		names := []string{inst.ID + hostsDomain}
+		values := []string{}
+		for key, value := range inst.Config.Labels {
+			if value == "" || value == inst.ID {
+				continue
+			}
+			if !validHostName(value) {
+				fmt.Printf("Skipping label %s=%s of %s, not a valid host name\n", key, value, inst.ID)
+				continue
+			}
+			values = append(values, value+hostsDomain)
+		}
+		sort.Strings(values)
+		names = append(names, values...)
+		lines = append(lines, address+"\t"+strings.Join(names, " "))
+	}
+	return lines, nil
+}
+
+// RFC 1123 : dot separated labels of letters, digits and inner hyphens, 63 chars at most each
+func validHostName(name string) bool {
+	if name == "" || len(name)+len(hostsDomain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Replace the managed block, or append it, leaving the rest of the file untouched
+func writeHostsBlock(hosts_file string, lines []string) error {
+	data, err := os.ReadFile(hosts_file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Reading %s : %w", hosts_file, err)
+	}
+	content := string(data)
+	if begin := strings.Index(content, hostsBlockBegin); begin >= 0 {
+		end := strings.Index(content[begin:], hostsBlockEnd)
+		if end < 0 {
+			return fmt.Errorf("%s has no %q line, fix it by hand", hosts_file, hostsBlockEnd)
+		}
+		end += begin + len(hostsBlockEnd)
+		content = content[:begin] + strings.TrimPrefix(content[end:], "\n")
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	block := append([]string{hostsBlockBegin}, lines...)
+	block = append(block, hostsBlockEnd)
+	content += strings.Join(block, "\n") + "\n"
+
+	// Written in place, /etc/hosts may be a bind mount that can't be replaced
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(hosts_file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(hosts_file, []byte(content), mode); err != nil {
+		return fmt.Errorf("Writing %s : %w", hosts_file, err)
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -28,13 +29,25 @@ const (
 	Stopped
 )
 
+func (state State) String() string {
+	switch state {
+	case Stopped:
+		return "Stopped"
+	case Running:
+		return "Running"
+	case Paused:
+		return "Paused"
+	}
+	return "Unknown"
+}
+
 type NetworkConfig struct {
-	Iface               string
-	SshUserPublicKey    string
-	SshServerPublicKey  string
-	SshServerPrivateKey string
-	IPV6                string
-	MacAddr             string
+	Iface             string
+	SshUserPublicKeys []string
+	SshServerKeys     []ServerKey // one per host key type
+	IPV6              string
+	MacAddr           string
+	Nics              []Nic // every NIC, the first one built from the top level settings
 }
 
 type Instance struct {
@@ -42,8 +55,10 @@ type Instance struct {
 	ConfigFileName string
 	Config         *InstanceConfig
 	Dir            string
-	ArchInfo       ArchInfo       // only used on create
-	NetworkConfig  *NetworkConfig // only used on create
+	Host           *Host
+	ArchInfo       ArchInfo       // filled by prepare()
+	NetworkConfig  *NetworkConfig // filled by prepare()
+	SeedRevision   string         // only set by the seed server
 }
 
 func buildInstance(id string, config_filename string) (*Instance, error) {
@@ -57,6 +72,7 @@ func buildInstance(id string, config_filename string) (*Instance, error) {
 		ConfigFileName: config_filename,
 		Config:         conf,
 		Dir:            path.Join("instances", id),
+		Host:           getHost(),
 		NetworkConfig:  &NetworkConfig{},
 	}, nil
 }
@@ -70,77 +86,162 @@ func (inst *Instance) exists() bool {
 // ----------------------------------------------------------------------------
 
 func (inst *Instance) setupSshKeys() error {
-	// First read the public user key
-	home, _ := os.UserHomeDir()
-	key_file := path.Join(home, inst.Config.SshPubKey)
-	data, err := os.ReadFile(key_file)
-	if err != nil {
-		return fmt.Errorf("Reading user public ssh key %s : %w", key_file, err)
+	if err := inst.createHostKeys(); err != nil {
+		return err
 	}
-	inst.NetworkConfig.SshUserPublicKey = string(data)
+	return inst.readSshKeys()
+}
 
-	// Then if server keys are missing, generate them
-	if !file_exists(path.Join("keys", "default_server_key")) || !file_exists(path.Join("keys", "default_server_key.pub")) {
-		fmt.Println("Generating server keys")
-		_ = os.MkdirAll("keys", 0755)
-		var publicKey, privateKey []byte
-		if err := generateRSAKeys(&publicKey, &privateKey, 4096); err != nil {
-			return err
-		}
-		if err := os.WriteFile("keys/default_server_key", privateKey, 0700); err != nil {
+// Generate the missing server keys, shared ones live in ./keys,
+// per-instance ones in the instance keys folder
+func (inst *Instance) createHostKeys() error {
+	if inst.Config.HostKeys != "per-instance" {
+		lock, err := lockResource("keys")
+		if err != nil {
 			return err
 		}
-		if err := os.WriteFile("keys/default_server_key.pub", publicKey, 0700); err != nil {
-			return err
+		defer lock.Release()
+	}
+	for _, key_type := range inst.hostKeyTypes() {
+		server_key := inst.hostKeyFile(key_type)
+		if !file_exists(server_key) || !file_exists(server_key+".pub") {
+			fmt.Printf("Generating %s server keys\n", key_type)
+			_ = os.MkdirAll(path.Dir(server_key), 0755)
+			var publicKey, privateKey []byte
+			if err := generateHostKeys(key_type, &publicKey, &privateKey); err != nil {
+				return err
+			}
+			if err := os.WriteFile(server_key, privateKey, 0600); err != nil {
+				return err
+			}
+			if err := os.WriteFile(server_key+".pub", publicKey, 0644); err != nil {
+				return err
+			}
 		}
+		// keys written by older versions were all 0700
+		_ = os.Chmod(server_key, 0600)
+		_ = os.Chmod(server_key+".pub", 0644)
 	}
+	return nil
+}
 
-	// Then read the server private key
-	key_file = path.Join("keys", "default_server_key")
-	data, err = os.ReadFile(key_file)
+// Read the user keys and the existing server keys, without any lock : ql serve
+// reads them for concurrent requests and never generates keys
+func (inst *Instance) readSshKeys() error {
+	// First gather the user keys to authorize
+	user_keys, err := inst.authorizedKeys()
 	if err != nil {
-		return fmt.Errorf("Reading user server ssh key %s : %w", key_file, err)
+		return err
 	}
-	inst.NetworkConfig.SshServerPrivateKey = strings.Join(strings.Split(string(data), "\n"), "\n    ")
+	inst.NetworkConfig.SshUserPublicKeys = user_keys
 
-	// And read the server public key
-	key_file = path.Join("keys", "default_server_key.pub")
-	data, err = os.ReadFile(key_file)
-	if err != nil {
-		return fmt.Errorf("Reading user server public ssh key %s : %w", key_file, err)
+	inst.NetworkConfig.SshServerKeys = []ServerKey{}
+	for _, key_type := range inst.hostKeyTypes() {
+		server_key := inst.hostKeyFile(key_type)
+		// Then read the server private key
+		private, err := os.ReadFile(server_key)
+		if err != nil {
+			return fmt.Errorf("Reading server ssh key %s : %w", server_key, err)
+		}
+		// And the server public key
+		public, err := os.ReadFile(server_key + ".pub")
+		if err != nil {
+			return fmt.Errorf("Reading server public ssh key %s : %w", server_key+".pub", err)
+		}
+		inst.NetworkConfig.SshServerKeys = append(inst.NetworkConfig.SshServerKeys, ServerKey{
+			Type:    key_type,
+			Private: strings.Join(strings.Split(strings.TrimSpace(string(private)), "\n"), "\n    "),
+			Public:  strings.TrimSpace(string(public)),
+		})
 	}
-	inst.NetworkConfig.SshServerPublicKey = string(data)
 	return nil
 }
 
+// Host key types of the instance, instances created before they could be chosen only have an RSA one
+func (inst *Instance) hostKeyTypes() []string {
+	if len(inst.Config.HostKeyTypes) == 0 {
+		return []string{"rsa"}
+	}
+	return inst.Config.HostKeyTypes
+}
+
+// Server private key of the instance for a key type, the public one is next to it
+func (inst *Instance) hostKeyFile(key_type string) string {
+	if inst.Config.HostKeys == "per-instance" {
+		return path.Join(inst.Dir, "keys", "ssh_host_"+key_type+"_key")
+	}
+	if key_type == "rsa" {
+		return path.Join("keys", "default_server_key")
+	}
+	return path.Join("keys", "default_server_"+key_type+"_key")
+}
+
 // ----------------------------------------------------------------------------
 // Create a new instance - overwrite if forced and possible
 // ----------------------------------------------------------------------------
 
 func (inst *Instance) Create(force bool) error {
-	if force {
-		if err := inst.Destroy(); err != nil {
+	if inst.exists() {
+		if !force {
+			return fmt.Errorf("Instance already exists")
+		}
+		if err := inst.checkDestroyable(); err != nil {
 			return err
 		}
-	} else {
-		if inst.exists() {
-			return fmt.Errorf("Instance already exists")
+	}
+
+	// Everything is built into a staging folder, which becomes instances/<id> only once complete
+	final_dir := inst.Dir
+	staging_dir := path.Join("instances", "."+inst.ID+".staging")
+	if err := os.RemoveAll(staging_dir); err != nil { // leftover of a killed create
+		return err
+	}
+	if err := os.MkdirAll(staging_dir, 0755); err != nil {
+		return err
+	}
+	inst.Dir = staging_dir
+	err := inst.build()
+	inst.Dir = final_dir
+	if err != nil {
+		_ = os.RemoveAll(staging_dir)
+		return err
+	}
+
+	if force && inst.exists() {
+		// The history goes on, it tells who re-created the instance
+		history_file := path.Join(final_dir, "history.jsonl")
+		if file_exists(history_file) {
+			if _, err := file_cp(history_file, path.Join(staging_dir, "history.jsonl")); err != nil {
+				_ = os.RemoveAll(staging_dir)
+				return err
+			}
+		}
+		if err := inst.Destroy(); err != nil {
+			_ = os.RemoveAll(staging_dir)
+			return err
 		}
 	}
-	_ = os.MkdirAll(inst.Dir, 0755)
+	if err := os.Rename(staging_dir, final_dir); err != nil {
+		_ = os.RemoveAll(staging_dir)
+		return err
+	}
+	fmt.Printf("Instance %s created\n", inst.ID)
+	return nil
+}
 
+// Build all the instance files into inst.Dir, stop at the first error
+func (inst *Instance) build() error {
 	// Download the base image
 	image := buildStockImage(inst.Config.Image)
 	inst.ArchInfo = image.ArchInfo
-	err := image.download()
-	if err != nil {
+	if err := image.download(); err != nil {
 		return fmt.Errorf("Download failed : %w", err)
 	}
 
 	// And copy it to the instance folder then resize it
 	src_image := path.Join("downloads", image.Name+".qcow2")
 	dst_image := path.Join(inst.Dir, "boot.qcow2")
-	if _, err = file_cp(src_image, dst_image); err != nil {
+	if _, err := file_cp(src_image, dst_image); err != nil {
 		return err
 	}
 	if err := inst.resizeBootDisk(); err != nil {
@@ -148,8 +249,7 @@ func (inst *Instance) Create(force bool) error {
 	}
 
 	// Copy the qemu firmware
-	bios := fmt.Sprintf("/opt/local/share/qemu/edk2-%s-code.fd", qemuArch())
-	if _, err = file_cp(bios, path.Join(inst.Dir, "bios.fd")); err != nil {
+	if _, err := file_cp(inst.Host.Firmware, path.Join(inst.Dir, "bios.fd")); err != nil {
 		return err
 	}
 
@@ -160,42 +260,43 @@ func (inst *Instance) Create(force bool) error {
 		return err
 	}
 	inst.Config.HostUser = currentUser.Username
-	out, err := yaml.Marshal(inst.Config)
-	if err != nil {
-		return err
+	if len(inst.Config.HostKeyTypes) == 0 {
+		inst.Config.HostKeyTypes = defaultHostKeyTypes
 	}
-
-	file, err := os.OpenFile(path.Join(inst.Dir, "config.yaml"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	if inst.Config.MacAddr == "" {
+		mac, err := genMACAddr() // each instance get a random MAC addr
+		if err != nil {
+			return err
+		}
+		inst.Config.MacAddr = mac
 	}
-	defer file.Close()
-	if _, err := file.Write(out); err != nil {
-		return err
+	for _, name := range inst.Config.PrivateNetworks {
+		inst.Config.Networks = append(inst.Config.Networks, NicConfig{Mode: "private", Name: name})
 	}
-	// Get and setup SSH keys, both for user and server
-	if err := inst.setupSshKeys(); err != nil {
-		return err
+	inst.Config.PrivateNetworks = nil
+	for i := range inst.Config.Networks {
+		if inst.Config.Networks[i].Mac == "" {
+			mac, err := genMACAddr()
+			if err != nil {
+				return err
+			}
+			inst.Config.Networks[i].Mac = mac
+		}
 	}
-
-	// Network stuff
-	if inst.ArchInfo.OS == "debian" {
-		inst.NetworkConfig.Iface = "enp0s1"
-	} else {
-		inst.NetworkConfig.Iface = "eth0"
+	err = inst.allocateNetwork(inst.saveConfig)
+	if err != nil {
+		return err
 	}
 
-	ipv6, err := IPv4ToIPv6(inst.Config.IpAddress)
-	if err != nil {
-		return nil
+	// Resolve ssh_pub_key once, agent and files are not there for ql serve or sudo
+	if err := inst.saveAuthorizedKeys(); err != nil {
+		return err
 	}
-	inst.NetworkConfig.IPV6 = ipv6
 
-	mac, err := genMACAddr() // each instance get a random MAC addr
-	if err != nil {
-		return nil
+	// Get SSH keys and network settings for the templates
+	if err := inst.prepare(); err != nil {
+		return err
 	}
-	inst.NetworkConfig.MacAddr = mac
 
 	// Generate the boot.sh script
 	if err := inst.genBootScript(); err != nil {
@@ -207,12 +308,37 @@ func (inst *Instance) Create(force bool) error {
 		return err
 	}
 
-	// Build the Cloud Init .iso
-	if err := inst.mk_iso(); err != nil {
-		return err
+	// Build the Cloud Init seed, unless the guest fetches it from `ql serve`
+	if inst.Config.SeedFormat == "net" {
+		return nil
 	}
-	fmt.Printf("Instance %s created\n", inst.ID)
-	return nil
+	return inst.mk_iso()
+}
+
+// ----------------------------------------------------------------------------
+// Fill everything the templates need but config.yaml doesn't hold
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) prepare() error {
+	inst.prepareNetwork()
+
+	// Get and setup SSH keys, both for user and server
+	return inst.setupSshKeys()
+}
+
+// What boot.sh and network-config need, no SSH keys
+func (inst *Instance) prepareNetwork() {
+	inst.ArchInfo = buildStockImage(inst.Config.Image).ArchInfo
+
+	if inst.ArchInfo.OS == "debian" {
+		inst.NetworkConfig.Iface = "enp0s1"
+	} else {
+		inst.NetworkConfig.Iface = "eth0"
+	}
+
+	inst.NetworkConfig.IPV6 = inst.IPv6Address()
+	inst.NetworkConfig.MacAddr = inst.Config.MacAddr
+	inst.NetworkConfig.Nics = inst.nics()
 }
 
 // ----------------------------------------------------------------------------
@@ -223,19 +349,41 @@ func (inst *Instance) Start(verbose bool) error {
 	if state, _ := inst.state(); state != Stopped {
 		return fmt.Errorf("Instance already running")
 	}
-	ipFree, err := inst.isIPFree()
-	if err != nil {
+	if err := inst.recoverMacAddr(); err != nil {
 		return err
 	}
-	if !ipFree {
-		return fmt.Errorf("IP address %s is currently used by another host", inst.Config.IpAddress)
+	if inst.Config.SeedFormat == "net" {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", inst.Config.SeedPort), 1*time.Second)
+		if err != nil {
+			return fmt.Errorf("No seed server on port %d, run ql serve first", inst.Config.SeedPort)
+		}
+		conn.Close()
+	}
+	if inst.Config.Network == "user" {
+		if !portFree(inst.Config.SshPort) {
+			return fmt.Errorf("SSH port %d is currently used on the host", inst.Config.SshPort)
+		}
+		for _, forward := range inst.Forwards() {
+			if forward.Proto == "tcp" && !portFree(forward.HostPort) {
+				return fmt.Errorf("Forwarded port %d is currently used on the host", forward.HostPort)
+			}
+		}
+	} else if inst.Config.Network == "bridged" {
+		ipFree, err := inst.isIPFree()
+		if err != nil {
+			return err
+		}
+		if !ipFree {
+			return fmt.Errorf("IP address %s is currently used by another host", inst.guestIP())
+		}
 	}
 
-	//if inst.Config.EnableVirtFS {
-	// if err := inst.genBootScript(); err != nil {
-	// 	return err
-	// }
-	//}
+	// boot.sh is rendered again, config changes such as port forwards apply on each start
+	// It needs no SSH keys : none are read, nor generated as root
+	inst.prepareNetwork()
+	if err := inst.genBootScript(); err != nil {
+		return err
+	}
 	absPath, _ := filepath.Abs(inst.Dir)
 	cmd := exec.Command("/bin/sh", path.Join(absPath, "boot.sh"))
 	cmd.Dir = absPath
@@ -271,24 +419,10 @@ func (inst *Instance) Stop() error {
 // ----------------------------------------------------------------------------
 
 func (inst *Instance) Destroy() error {
-	if inst.protected() {
-		return fmt.Errorf("instance is protected")
-	}
-	if state, _ := inst.state(); state != Stopped {
-		return fmt.Errorf("instance is running - stop it first")
-	}
-
-	share_folder := path.Join(inst.Dir, "share")
-	empty, err := isFolderEmpty(share_folder)
-	if err != nil {
+	if err := inst.checkDestroyable(); err != nil {
 		return err
 	}
-	if !empty {
-		return fmt.Errorf("You can't destroy this instance because %s folder is not empty", share_folder)
-	}
-
-	err = os.RemoveAll(inst.Dir)
-	if err != nil {
+	if err := os.RemoveAll(inst.Dir); err != nil {
 		return err
 	}
 	fmt.Printf("Instance %s destroyed\n", inst.ID)
@@ -318,15 +452,13 @@ func (inst *Instance) Status() State {
 	if err != nil {
 		fmt.Println(err)
 	}
-	switch state {
-	case Stopped:
-		fmt.Println("Stopped")
-	case Running:
-		fmt.Println("Running")
-	case Paused:
-		fmt.Println("Paused")
-	default:
-		fmt.Println("Unknow")
+	fmt.Println(state)
+	if inst.Config.Network != "bridged" && state == Running {
+		if ip := inst.sshHost(); ip != "" {
+			fmt.Printf("Address : %s\n", inst.sshAddress())
+		} else {
+			fmt.Println("Address : not found yet")
+		}
 	}
 	return state
 }
@@ -336,14 +468,17 @@ func (inst *Instance) Status() State {
 // ----------------------------------------------------------------------------
 
 func (inst *Instance) Shell() error {
+	if inst.sshHost() == "" {
+		return fmt.Errorf("No address known for instance %s, is it running ?", inst.ID)
+	}
 	retry := 0
 	for {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:22", inst.Config.IpAddress), 2000*time.Millisecond)
+		conn, err := net.DialTimeout("tcp", inst.sshAddress(), 2000*time.Millisecond)
 		if err != nil {
 			if errors.Is(err, syscall.ECONNREFUSED) {
 				break
 			} else {
-				fmt.Printf("Trying to connect %s@%s\n", inst.Config.UserName, inst.Config.IpAddress)
+				fmt.Printf("Trying to connect %s@%s\n", inst.Config.UserName, inst.sshAddress())
 				time.Sleep(2000 * time.Millisecond)
 				retry++
 				if retry >= 5 {
@@ -356,10 +491,20 @@ func (inst *Instance) Shell() error {
 		}
 	}
 
-	home, _ := os.UserHomeDir()
-	ssh_key_file := strings.TrimSuffix(inst.Config.SshPubKey, ".pub")
-	cmd := exec.Command("ssh", "-i", path.Join(home, ssh_key_file), fmt.Sprintf("%s@%s", inst.Config.UserName, inst.Config.IpAddress))
+	// Host keys are checked against ql's known_hosts, whatever the address is
+	if err := writeKnownHosts(); err != nil {
+		return err
+	}
+	known_hosts, _ := filepath.Abs(knownHostsFile)
+	args := []string{"-p", strconv.Itoa(inst.sshPort()),
+		"-o", "UserKnownHostsFile=" + known_hosts, "-o", "HostKeyAlias=" + inst.ID, "-o", "StrictHostKeyChecking=yes",
+		fmt.Sprintf("%s@%s", inst.Config.UserName, inst.sshHost())}
+	if identity_file := inst.identityFile(); identity_file != "" {
+		args = append([]string{"-i", identity_file}, args...)
+	}
+	cmd := exec.Command("ssh", args...)
 	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	err := cmd.Run()
 	if err != nil {
@@ -389,6 +534,25 @@ func (inst *Instance) protected() bool {
 	return file_exists(path.Join(inst.Dir, "protect"))
 }
 
+func (inst *Instance) checkDestroyable() error {
+	if inst.protected() {
+		return fmt.Errorf("instance is protected")
+	}
+	if state, _ := inst.state(); state != Stopped {
+		return fmt.Errorf("instance is running - stop it first")
+	}
+
+	share_folder := path.Join(inst.Dir, "share")
+	empty, err := isFolderEmpty(share_folder)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("You can't destroy this instance because %s folder is not empty", share_folder)
+	}
+	return nil
+}
+
 func isFolderEmpty(path string) (bool, error) {
 	entries, err := os.ReadDir(path)
 	if err != nil {
@@ -397,6 +561,14 @@ func isFolderEmpty(path string) (bool, error) {
 	return len(entries) == 0, nil
 }
 
+func (inst *Instance) saveConfig() error {
+	out, err := yaml.Marshal(inst.Config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(inst.Dir, "config.yaml"), out, 0644)
+}
+
 func (inst *Instance) genBootScript() error {
 	boot_sh := path.Join(inst.Dir, "boot.sh")
 	if err := inst.render_template("templates/boot.sh", boot_sh); err != nil {
@@ -414,7 +586,7 @@ func (inst *Instance) isIPFree() (bool, error) {
 }
 
 func (inst *Instance) PingVM(timeout time.Duration, count int) (*probing.Statistics, error) {
-	pinger, err := probing.NewPinger(inst.Config.IpAddress)
+	pinger, err := probing.NewPinger(inst.guestIP())
 	if err != nil {
 		return nil, err
 	}
@@ -432,21 +604,23 @@ func (inst *Instance) resizeBootDisk() error {
 	cmd := exec.Command("qemu-img", "info", boot_file, "--output=json")
 	out, err := cmd.Output()
 	if err != nil {
-		return nil
+		return fmt.Errorf("Cmd qemu-img info failed %w", err)
 	}
-	var result map[string]interface{}
-	if err = json.Unmarshal([]byte(out), &result); err != nil {
-		return nil
+	var result struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err = json.Unmarshal(out, &result); err != nil {
+		return fmt.Errorf("Parsing JSON %w", err)
+	}
+	new_size := int64(inst.Config.DiskSize) * 1024 * 1024 * 1024
+	if new_size < result.VirtualSize {
+		return fmt.Errorf("Shrinking disk is not possible")
 	}
-	actual_size := int64(result["actual-size"].(float64))
-	new_size := int64(inst.Config.DiskSize * 1024 * 1024 * 1024)
-	if new_size > actual_size {
+	if new_size > result.VirtualSize {
 		cmd := exec.Command("qemu-img", "resize", boot_file, fmt.Sprintf("%dG", inst.Config.DiskSize))
-		if err := cmd.Run(); err != nil {
-			return err
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Cmd qemu-img resize failed with [%s] %w", string(out), err)
 		}
-	} else {
-		return fmt.Errorf("Shrinking disk is not possible")
 	}
 	return nil
 }
@@ -510,3 +684,31 @@ func socketCmd(socket net.Conn, cmd string) (string, error) {
 	}
 	return socketRead(socket)
 }
+
+// Send a QMP command and return its "return" payload, skipping asynchronous events
+func qmpCmd(socket net.Conn, cmd string) (json.RawMessage, error) {
+	res, err := socketCmd(socket, cmd)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(strings.NewReader(res))
+	for decoder.More() {
+		var reply struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Class string `json:"class"`
+				Desc  string `json:"desc"`
+			} `json:"error"`
+		}
+		if err := decoder.Decode(&reply); err != nil {
+			return nil, fmt.Errorf("Parsing JSON %w", err)
+		}
+		if reply.Error != nil {
+			return nil, fmt.Errorf("%s", reply.Error.Desc)
+		}
+		if reply.Return != nil {
+			return reply.Return, nil
+		}
+	}
+	return nil, fmt.Errorf("No reply from QMP")
+}
@@ -2,24 +2,64 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
 	"gopkg.in/yaml.v3"
 )
 
 type InstanceConfig struct {
-	Image        string `validate:"required"`
-	IpAddress    string `yaml:"ip_address" validate:"required"`
-	Gateway      string
-	SshPubKey    string `yaml:"ssh_pub_key" validate:"required"`
-	Smp          int    `validate:"gt=0"`
-	Mem          int    `validate:"gt=0"`
-	DiskSize     int    `yaml:"disk_size" validate:"gt=0"`
-	UserName     string `yaml:"user_name" validate:"required"`
-	Samba        bool
-	HostUser     string `yaml:"host_user"`
-	EnableVirtFS bool   `yaml:"enable_virtfs"`
+	Image           string     `validate:"required"`
+	IpAddress       string     `yaml:"ip_address" validate:"required_if=Network bridged IPv6 none,required_if=Network bridged IPv6 auto,omitempty,eq=auto|ipv4|ipv4_prefix"`
+	Prefix          int        `yaml:"prefix,omitempty" validate:"gte=0,lte=32"`           // when ip_address has no /prefix, 24 when not set
+	IPv6            string     `yaml:"ipv6" validate:"eq=auto|eq=ula|eq=none|ipv6_prefix"` // ip_address may be left out on bridged networks with ula or a static one
+	IPv6Gateway     string     `yaml:"ipv6_gateway,omitempty" validate:"omitempty,ipv6"`
+	Gateway         string     `validate:"omitempty,ipv4"`
+	DnsServers      []string   `yaml:"dns_servers" validate:"dive,ip"`
+	SearchDomains   []string   `yaml:"search_domains,omitempty" validate:"dive,hostname_rfc1123"`
+	Mtu             int        `yaml:"mtu,omitempty" validate:"omitempty,gte=576,lte=9216"`
+	Routes          []Route    `yaml:"routes,omitempty" validate:"dive"`
+	SshPubKey       SshPubKeys `yaml:"ssh_pub_key" validate:"min=1,dive,required"` // files relative to $HOME, inline keys or agent
+	Smp             int        `validate:"gt=0"`
+	Mem             int        `validate:"gt=0"`
+	MemMin          int        `yaml:"mem_min" validate:"gte=0,ltefield=Mem"`
+	DiskSize        int        `yaml:"disk_size" validate:"gt=0"`
+	UserName        string     `yaml:"user_name" validate:"required"`
+	Samba           bool
+	Network         string            `yaml:"network" validate:"oneof=bridged user shared host"`
+	Forwards        []string          `yaml:"forwards,omitempty" validate:"dive,forward_rule"` // user network only, see ql forward
+	SshPort         int               `yaml:"ssh_port" validate:"gte=0,lt=65536"`
+	Bridge          string            `yaml:"bridge"` // Linux host bridge, br0 or virbr0 when not set
+	HostKeys        string            `yaml:"host_keys" validate:"oneof=shared per-instance"`
+	HostKeyTypes    []string          `yaml:"host_key_types" validate:"dive,oneof=ed25519 ecdsa rsa"` // ed25519 and ecdsa when not set
+	HostUser        string            `yaml:"host_user"`
+	EnableVirtFS    bool              `yaml:"enable_virtfs"`
+	SeedFormat      string            `yaml:"seed_format" validate:"oneof=iso vfat net"`
+	SeedPort        int               `yaml:"seed_port" validate:"gt=0,lt=65536"`
+	MacAddr         string            `yaml:"mac_addr" validate:"omitempty,mac"`
+	Description     string            `yaml:"description,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty" validate:"dive,keys,required,excludesall=!=0x2C,endkeys,excludesall=0x2C"`
+	Networks        []NicConfig       `yaml:"networks,omitempty" validate:"dive"`                          // extra NICs, the first one comes from the settings above
+	PrivateNetworks []string          `yaml:"private_networks,omitempty" validate:"dive,hostname_rfc1123"` // turned into networks entries at creation
+}
+
+type NicConfig struct {
+	Mode         string   `validate:"oneof=bridged user shared host private"`
+	Name         string   `yaml:"name,omitempty" validate:"required_if=Mode private"` // private network name
+	HostIface    string   `yaml:"host_iface,omitempty"`                               // bridge on Linux, interface bridged to on macOS
+	Mac          string   `yaml:"mac,omitempty" validate:"omitempty,mac"`
+	Addresses    []string `yaml:"addresses,omitempty" validate:"dive,ipv4_prefix|ipv4"` // DHCP when not set
+	DefaultRoute bool     `yaml:"default_route,omitempty"`
+	Gateway      string   `yaml:"gateway,omitempty" validate:"omitempty,ipv4"`
+}
+
+type Route struct {
+	To     string `validate:"required,cidr"`
+	Via    string `validate:"required,ip"`
+	Metric int    `yaml:"metric,omitempty" validate:"gte=0"`
 }
 
 func buildInstanceConfig() *InstanceConfig {
@@ -28,8 +68,14 @@ func buildInstanceConfig() *InstanceConfig {
 		Mem:          8,
 		DiskSize:     40,
 		Gateway:      "192.168.1.254",
+		DnsServers:   []string{"1.1.1.1", "8.8.8.8"},
+		IPv6:         "none",
+		HostKeys:     "shared",
+		Network:      "bridged",
 		Samba:        false,
 		EnableVirtFS: false,
+		SeedFormat:   "iso",
+		SeedPort:     8111,
 	}
 }
 
@@ -47,6 +93,9 @@ func (conf *InstanceConfig) Load(config_file string) error {
 	}
 
 	var validate = validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterValidation("ipv4_prefix", isIPv4Prefix)
+	validate.RegisterValidation("ipv6_prefix", isIPv6Prefix)
+	validate.RegisterValidation("forward_rule", isForwardRule)
 	err = validate.Struct(conf)
 	if err != nil {
 		return fmt.Errorf("Validating config file %s : %s", config_file, err)
@@ -54,3 +103,45 @@ func (conf *InstanceConfig) Load(config_file string) error {
 
 	return nil
 }
+
+// ----------------------------------------------------------------------------
+// ip_address is either a bare address or an address with its prefix length,
+// 192.168.1.70 or 192.168.1.70/22
+// ----------------------------------------------------------------------------
+
+// Whether a NIC goes through the host networking, so that sudo is needed
+// user mode and private networks stay inside qemu and the loopback
+func (conf *InstanceConfig) needsRoot() bool {
+	if conf.Network != "user" {
+		return true
+	}
+	for _, nic := range conf.Networks {
+		if nic.Mode != "user" && nic.Mode != "private" {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *InstanceConfig) Address() string {
+	address, _, _ := strings.Cut(conf.IpAddress, "/")
+	return address
+}
+
+func (conf *InstanceConfig) PrefixLen() int {
+	if _, prefix, found := strings.Cut(conf.IpAddress, "/"); found {
+		if length, err := strconv.Atoi(prefix); err == nil {
+			return length
+		}
+	}
+	if conf.Prefix > 0 {
+		return conf.Prefix
+	}
+	return 24
+}
+
+// An IPv4 address with a prefix length, unlike cidrv4 the host bits may be set
+func isIPv4Prefix(fl validator.FieldLevel) bool {
+	ip, _, err := net.ParseCIDR(fl.Field().String())
+	return err == nil && ip.To4() != nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Instance IDs found under ./instances, staging folders excluded
+// ----------------------------------------------------------------------------
+
+func listInstances() ([]string, error) {
+	entries, err := os.ReadDir("instances")
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func loadInstance(id string) (*Instance, error) {
+	return buildInstance(id, path.Join("instances", id, "config.yaml"))
+}
+
+// All the instances whose labels match the selector
+func selectInstances(selector string) ([]*Instance, error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := listInstances()
+	if err != nil {
+		return nil, err
+	}
+	insts := []*Instance{}
+	for _, id := range ids {
+		inst, err := loadInstance(id)
+		if err != nil {
+			return nil, fmt.Errorf("Instance %s : %w", id, err)
+		}
+		if sel.Matches(inst.Config.Labels) {
+			insts = append(insts, inst)
+		}
+	}
+	return insts, nil
+}
+
+// ----------------------------------------------------------------------------
+// List instances with their state, address, labels and description
+// ----------------------------------------------------------------------------
+
+func List(selector string) error {
+	insts, err := selectInstances(selector)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-16s %-8s %-21s %-30s %s\n", "ID", "STATE", "ADDRESS", "LABELS", "DESCRIPTION")
+	for _, inst := range insts {
+		state, _ := inst.state()
+		address := inst.sshHost()
+		if inst.Config.Network == "user" {
+			address = inst.sshAddress()
+		}
+		fmt.Printf("%-16s %-8s %-21s %-30s %s\n", inst.ID, state, address, formatLabels(inst.Config.Labels), inst.Config.Description)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Ansible dynamic inventory - one group per label, named <key>_<value>
+// ----------------------------------------------------------------------------
+
+func Inventory(selector string) error {
+	insts, err := selectInstances(selector)
+	if err != nil {
+		return err
+	}
+	all := []string{}
+	hostvars := map[string]map[string]any{}
+	inventory := map[string]any{}
+	groups := map[string][]string{}
+	for _, inst := range insts {
+		all = append(all, inst.ID)
+		hostvars[inst.ID] = map[string]any{
+			"ansible_host":   inst.sshHost(),
+			"ansible_port":   inst.sshPort(),
+			"ansible_user":   inst.Config.UserName,
+			"ql_labels":      inst.Config.Labels,
+			"ql_description": inst.Config.Description,
+		}
+		if identity_file := inst.identityFile(); identity_file != "" {
+			hostvars[inst.ID]["ansible_ssh_private_key_file"] = identity_file
+		}
+		for key, value := range inst.Config.Labels {
+			group := key + "_" + value
+			groups[group] = append(groups[group], inst.ID)
+		}
+	}
+	for group, hosts := range groups {
+		inventory[group] = map[string]any{"hosts": hosts}
+	}
+	inventory["all"] = map[string]any{"hosts": all}
+	inventory["_meta"] = map[string]any{"hostvars": hostvars}
+
+	out, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	formatted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		formatted = append(formatted, key+"="+labels[key])
+	}
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ----------------------------------------------------------------------------
+// Guest IPv6 address, from the ipv6 setting :
+// - auto : SLAAC or DHCPv6, the address is up to the network
+// - ula : fd00::/8 address, the same prefix for every ql instance and an
+//   interface id derived from the MAC address, so it is stable per instance
+// - a static address with its prefix, eg. 2001:db8::70/64
+// - none : no IPv6 settings at all
+// ----------------------------------------------------------------------------
+
+// A constant global id, so that ql instances all share the same on-link /64
+var ulaPrefix = func() []byte {
+	sum := sha256.Sum256([]byte("ql-bienno"))
+	return append([]byte{0xfd}, sum[:5]...)
+}()
+
+// Static IPv6 address of the instance with its prefix, empty when not known in advance
+func (inst *Instance) IPv6Address() string {
+	switch inst.Config.IPv6 {
+	case "", "none", "auto":
+		return ""
+	case "ula":
+		return ulaAddress(inst.Config.MacAddr)
+	}
+	return inst.Config.IPv6
+}
+
+// The IPv6 address alone, without its prefix
+func (inst *Instance) ipv6Host() string {
+	address, _, _ := strings.Cut(inst.IPv6Address(), "/")
+	return address
+}
+
+func ulaAddress(mac string) string {
+	if mac == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalizeMAC(mac)))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ulaPrefix) // subnet id 0
+	copy(ip[8:], sum[:8])
+	return fmt.Sprintf("%s/64", ip)
+}
+
+// An IPv6 address with a prefix length, the host bits may be set
+func isIPv6Prefix(fl validator.FieldLevel) bool {
+	ip, _, err := net.ParseCIDR(fl.Field().String())
+	return err == nil && ip.To4() == nil
+}
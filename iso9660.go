@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// ----------------------------------------------------------------------------
+// A minimal ISO9660 writer, enough for a Cloud Init seed :
+// - a single root directory holding a few small files
+// - Joliet and Rock Ridge names, so the guest sees meta-data and not META_DATA.;1
+// - no timestamps from the clock, same files in gives the same bytes out
+// ----------------------------------------------------------------------------
+
+const isoSectorSize = 2048
+
+type SeedFile struct {
+	Name string
+	Data []byte
+}
+
+type isoFile struct {
+	SeedFile
+	extent uint32
+}
+
+func buildISO(volume_id string, files []SeedFile) []byte {
+	// Sectors 0-15 system area, 16 PVD, 17 Joliet SVD, 18 terminator
+	// then path tables and root directories, then the files data
+	const (
+		pvdSector    = 16
+		svdSector    = 17
+		termSector   = 18
+		pathTableL   = 19
+		pathTableM   = 20
+		jolietTableL = 21
+		jolietTableM = 22
+		rootSector   = 23
+	)
+
+	sorted := make([]isoFile, len(files))
+	for i, file := range files {
+		sorted[i] = isoFile{SeedFile: file}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	// Both directories are laid out once to know their size, then for real
+	rootSectors := sectorsFor(len(isoDirectory(sorted, rootSector, 1, false)))
+	jolietSector := uint32(rootSector + rootSectors)
+	jolietSectors := sectorsFor(len(isoDirectory(sorted, jolietSector, 1, true)))
+
+	next := jolietSector + uint32(jolietSectors)
+	for i := range sorted {
+		sorted[i].extent = next
+		next += uint32(sectorsFor(len(sorted[i].Data)))
+	}
+	total := next
+
+	root := isoDirectory(sorted, rootSector, uint32(rootSectors), false)
+	joliet := isoDirectory(sorted, jolietSector, uint32(jolietSectors), true)
+
+	image := make([]byte, int(total)*isoSectorSize)
+	put := func(sector uint32, data []byte) {
+		copy(image[int(sector)*isoSectorSize:], data)
+	}
+
+	put(pvdSector, isoVolumeDescriptor(1, volume_id, total, rootSector, uint32(rootSectors), pathTableL, pathTableM, false))
+	put(svdSector, isoVolumeDescriptor(2, volume_id, total, jolietSector, uint32(jolietSectors), jolietTableL, jolietTableM, true))
+	put(termSector, append([]byte{255}, []byte("CD001\x01")...))
+	put(pathTableL, isoPathTable(rootSector, binary.LittleEndian))
+	put(pathTableM, isoPathTable(rootSector, binary.BigEndian))
+	put(jolietTableL, isoPathTable(jolietSector, binary.LittleEndian))
+	put(jolietTableM, isoPathTable(jolietSector, binary.BigEndian))
+	put(rootSector, root)
+	put(jolietSector, joliet)
+	for _, file := range sorted {
+		put(file.extent, file.Data)
+	}
+	return image
+}
+
+func sectorsFor(size int) int {
+	return max(1, (size+isoSectorSize-1)/isoSectorSize)
+}
+
+// ----------------------------------------------------------------------------
+// Volume descriptors, primary (type 1) or Joliet supplementary (type 2)
+// ----------------------------------------------------------------------------
+
+func isoVolumeDescriptor(kind byte, volume_id string, total uint32, root uint32, root_sectors uint32, table_l uint32, table_m uint32, joliet bool) []byte {
+	desc := make([]byte, isoSectorSize)
+	desc[0] = kind
+	copy(desc[1:], "CD001")
+	desc[6] = 1
+
+	text := func(offset int, size int, value string) {
+		if joliet {
+			copy(desc[offset:offset+size], ucs2Padded(value, size))
+		} else {
+			copy(desc[offset:offset+size], []byte(value+strings.Repeat(" ", size-len(value))))
+		}
+	}
+	text(8, 32, "")
+	text(40, 32, volume_id)
+	putBoth32(desc[80:], total)
+	if joliet {
+		copy(desc[88:], "%/E") // UCS-2 level 3
+	}
+	putBoth16(desc[120:], 1) // volume set size
+	putBoth16(desc[124:], 1) // volume sequence number
+	putBoth16(desc[128:], isoSectorSize)
+	putBoth32(desc[132:], 10) // path table size, a single entry for the root
+	binary.LittleEndian.PutUint32(desc[140:], table_l)
+	binary.BigEndian.PutUint32(desc[148:], table_m)
+	copy(desc[156:], isoRecord([]byte{0}, root, root_sectors*isoSectorSize, true, nil))
+	text(190, 128, "") // volume set
+	text(318, 128, "") // publisher
+	text(446, 128, "") // data preparer
+	text(574, 128, "QL-BIENNO")
+	text(702, 37, "")                                  // copyright file
+	text(739, 37, "")                                  // abstract file
+	text(776, 37, "")                                  // bibliographic file
+	for _, offset := range []int{813, 830, 847, 864} { // dates, left unspecified
+		copy(desc[offset:], "0000000000000000\x00")
+	}
+	desc[881] = 1 // file structure version
+	return desc
+}
+
+func isoPathTable(root uint32, order binary.ByteOrder) []byte {
+	table := make([]byte, 10)
+	table[0] = 1 // identifier length
+	order.PutUint32(table[2:], root)
+	order.PutUint16(table[6:], 1) // parent directory number
+	return table
+}
+
+// ----------------------------------------------------------------------------
+// Root directory : ".", ".." then the files, records never cross a sector
+// ----------------------------------------------------------------------------
+
+func isoDirectory(files []isoFile, self uint32, sectors uint32, joliet bool) []byte {
+	size := sectors * isoSectorSize
+	var dot, dotdot []byte
+	if joliet {
+		dot = isoRecord([]byte{0}, self, size, true, nil)
+		dotdot = isoRecord([]byte{1}, self, size, true, nil)
+	} else {
+		dot = isoRecord([]byte{0}, self, size, true, rockRidgeRoot())
+		dotdot = isoRecord([]byte{1}, self, size, true, rockRidgePX(true))
+	}
+	records := [][]byte{dot, dotdot}
+
+	if joliet {
+		sort.Slice(files, func(i, j int) bool { return bytes.Compare(ucs2(files[i].Name), ucs2(files[j].Name)) < 0 })
+	} else {
+		sort.Slice(files, func(i, j int) bool { return isoName(files[i].Name) < isoName(files[j].Name) })
+	}
+	for _, file := range files {
+		if joliet {
+			records = append(records, isoRecord(ucs2(file.Name), file.extent, uint32(len(file.Data)), false, nil))
+		} else {
+			system_use := append(rockRidgePX(false), rockRidgeNM(file.Name)...)
+			records = append(records, isoRecord([]byte(isoName(file.Name)), file.extent, uint32(len(file.Data)), false, system_use))
+		}
+	}
+
+	var dir bytes.Buffer
+	for _, record := range records {
+		used := dir.Len() % isoSectorSize
+		if used+len(record) > isoSectorSize {
+			dir.Write(make([]byte, isoSectorSize-used))
+		}
+		dir.Write(record)
+	}
+	return dir.Bytes()
+}
+
+func isoRecord(identifier []byte, extent uint32, size uint32, directory bool, system_use []byte) []byte {
+	length := 33 + len(identifier)
+	if length%2 == 1 {
+		length++
+	}
+	record := make([]byte, length, length+len(system_use)+1)
+	putBoth32(record[2:], extent)
+	putBoth32(record[10:], size)
+	copy(record[18:], []byte{70, 1, 1, 0, 0, 0, 0}) // 1970-01-01 00:00:00 UTC
+	if directory {
+		record[25] = 2
+	}
+	putBoth16(record[28:], 1) // volume sequence number
+	record[32] = byte(len(identifier))
+	copy(record[33:], identifier)
+	record = append(record, system_use...)
+	if len(record)%2 == 1 {
+		record = append(record, 0)
+	}
+	record[0] = byte(len(record))
+	return record
+}
+
+// Level 2 ISO9660 file name : uppercase d-characters, a dot and the version
+func isoName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	if len(mapped) > 30 {
+		mapped = mapped[:30]
+	}
+	return mapped + ".;1"
+}
+
+// ----------------------------------------------------------------------------
+// Rock Ridge (SUSP) entries : SP and ER announce the extension in the root ".",
+// PX gives permissions and NM the real file name
+// ----------------------------------------------------------------------------
+
+func rockRidgeRoot() []byte {
+	sp := []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+	id := "RRIP_1991A"
+	er := append([]byte{'E', 'R', byte(8 + len(id)), 1, byte(len(id)), 0, 0, 1}, id...)
+	entries := append(sp, rockRidgePX(true)...)
+	return append(entries, er...)
+}
+
+func rockRidgePX(directory bool) []byte {
+	mode, links := uint32(0100444), uint32(1)
+	if directory {
+		mode, links = 040555, 2
+	}
+	px := make([]byte, 36)
+	copy(px, []byte{'P', 'X', 36, 1})
+	putBoth32(px[4:], mode)
+	putBoth32(px[12:], links)
+	// uid and gid stay 0
+	return px
+}
+
+func rockRidgeNM(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// ----------------------------------------------------------------------------
+// Encoding helpers
+// ----------------------------------------------------------------------------
+
+func putBoth16(buf []byte, value uint16) {
+	binary.LittleEndian.PutUint16(buf, value)
+	binary.BigEndian.PutUint16(buf[2:], value)
+}
+
+func putBoth32(buf []byte, value uint32) {
+	binary.LittleEndian.PutUint32(buf, value)
+	binary.BigEndian.PutUint32(buf[4:], value)
+}
+
+func ucs2(value string) []byte {
+	encoded := utf16.Encode([]rune(value))
+	out := make([]byte, 2*len(encoded))
+	for i, unit := range encoded {
+		binary.BigEndian.PutUint16(out[2*i:], unit)
+	}
+	return out
+}
+
+func ucs2Padded(value string, size int) []byte {
+	out := make([]byte, size)
+	for i := 0; i+1 < size; i += 2 {
+		out[i+1] = ' '
+	}
+	copy(out, ucs2(value))
+	return out
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// A seed as ql renders it, user-data spanning several sectors
+func testSeedFiles() []SeedFile {
+	return []SeedFile{
+		{Name: "user-data", Data: []byte("#cloud-config\n" + strings.Repeat("# padding line\n", 400))},
+		{Name: "meta-data", Data: []byte("instance-id: foobar\nlocal-hostname: foobar\n")},
+		{Name: "network-config", Data: []byte("version: 2\nethernets: {}\n")},
+		{Name: "vendor-data", Data: []byte{}},
+	}
+}
+
+type isoTestRecord struct {
+	identifier []byte
+	extent     uint32
+	size       uint32
+	directory  bool
+	system_use []byte
+}
+
+func isoSector(image []byte, sector uint32) []byte {
+	return image[int(sector)*isoSectorSize : int(sector+1)*isoSectorSize]
+}
+
+func parseIsoRecord(data []byte) isoTestRecord {
+	id_len := int(data[32])
+	system_use := 33 + id_len
+	if system_use%2 == 1 {
+		system_use++
+	}
+	return isoTestRecord{
+		identifier: data[33 : 33+id_len],
+		extent:     binary.LittleEndian.Uint32(data[2:]),
+		size:       binary.LittleEndian.Uint32(data[10:]),
+		directory:  data[25]&2 != 0,
+		system_use: data[system_use:data[0]],
+	}
+}
+
+// Every record of a directory, zero length records pad up to the next sector
+func parseIsoDirectory(t *testing.T, image []byte, root isoTestRecord) []isoTestRecord {
+	t.Helper()
+	dir := image[int(root.extent)*isoSectorSize : int(root.extent)*isoSectorSize+int(root.size)]
+	records := []isoTestRecord{}
+	for offset := 0; offset < len(dir); {
+		length := int(dir[offset])
+		if length == 0 {
+			offset = (offset/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if offset%isoSectorSize+length > isoSectorSize {
+			t.Fatalf("Record at %d crosses a sector", offset)
+		}
+		records = append(records, parseIsoRecord(dir[offset:offset+length]))
+		offset += length
+	}
+	return records
+}
+
+// The Rock Ridge NM name among the SUSP entries of a record
+func rockRidgeName(system_use []byte) string {
+	for offset := 0; offset+4 <= len(system_use); {
+		length := int(system_use[offset+2])
+		if length == 0 {
+			break
+		}
+		if string(system_use[offset:offset+2]) == "NM" {
+			return string(system_use[offset+5 : offset+length])
+		}
+		offset += length
+	}
+	return ""
+}
+
+func TestBuildISOIsReproducible(t *testing.T) {
+	files := testSeedFiles()
+	first := buildISO("cidata", files)
+	reversed := []SeedFile{}
+	for i := len(files) - 1; i >= 0; i-- {
+		reversed = append(reversed, files[i])
+	}
+	second := buildISO("cidata", reversed)
+	if !bytes.Equal(first, second) {
+		t.Fatal("Two builds of the same seed differ")
+	}
+	if len(first)%isoSectorSize != 0 {
+		t.Fatalf("Image size %d is not a multiple of the sector size", len(first))
+	}
+}
+
+func TestBuildISOVolumeDescriptors(t *testing.T) {
+	image := buildISO("cidata", testSeedFiles())
+
+	pvd := isoSector(image, 16)
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		t.Fatalf("Sector 16 is not a primary volume descriptor")
+	}
+	if volume_id := string(pvd[40:72]); volume_id != "cidata"+strings.Repeat(" ", 26) {
+		t.Errorf("PVD volume id %q", volume_id)
+	}
+	if total := binary.LittleEndian.Uint32(pvd[80:]); int(total)*isoSectorSize != len(image) {
+		t.Errorf("PVD volume size %d sectors, image has %d bytes", total, len(image))
+	}
+
+	svd := isoSector(image, 17)
+	if svd[0] != 2 || string(svd[1:6]) != "CD001" || string(svd[88:91]) != "%/E" {
+		t.Fatalf("Sector 17 is not a Joliet supplementary volume descriptor")
+	}
+	if volume_id := svd[40:72]; !bytes.Equal(volume_id, ucs2Padded("cidata", 32)) {
+		t.Errorf("Joliet volume id %q", volume_id)
+	}
+
+	if terminator := isoSector(image, 18); terminator[0] != 255 || string(terminator[1:6]) != "CD001" {
+		t.Errorf("Sector 18 is not a volume descriptor set terminator")
+	}
+}
+
+func TestBuildISORootDirectories(t *testing.T) {
+	files := testSeedFiles()
+	image := buildISO("cidata", files)
+	by_name := map[string][]byte{}
+	for _, file := range files {
+		by_name[file.Name] = file.Data
+	}
+
+	check := func(kind string, records []isoTestRecord, name func(isoTestRecord) string) {
+		if len(records) != 2+len(files) {
+			t.Fatalf("%s root has %d records, expected %d", kind, len(records), 2+len(files))
+		}
+		if !bytes.Equal(records[0].identifier, []byte{0}) || !bytes.Equal(records[1].identifier, []byte{1}) || !records[0].directory {
+			t.Errorf("%s root does not start with . and ..", kind)
+		}
+		for _, record := range records[2:] {
+			file_name := name(record)
+			data, found := by_name[file_name]
+			if !found {
+				t.Errorf("%s root has an unexpected file %q", kind, file_name)
+				continue
+			}
+			if int(record.size) != len(data) {
+				t.Errorf("%s %s has size %d, expected %d", kind, file_name, record.size, len(data))
+			}
+			start := int(record.extent) * isoSectorSize
+			if !bytes.Equal(image[start:start+int(record.size)], data) {
+				t.Errorf("%s %s content differs", kind, file_name)
+			}
+		}
+	}
+
+	// Primary root : ISO9660 names, the real ones in Rock Ridge NM entries
+	pvd_root := parseIsoRecord(isoSector(image, 16)[156:])
+	primary := parseIsoDirectory(t, image, pvd_root)
+	if !bytes.HasPrefix(primary[0].system_use, []byte{'S', 'P', 7, 1, 0xBE, 0xEF}) {
+		t.Errorf("Root . has no SUSP SP entry")
+	}
+	if !bytes.Contains(primary[0].system_use, []byte("RRIP_1991A")) {
+		t.Errorf("Root . has no Rock Ridge ER entry")
+	}
+	check("Primary", primary, func(record isoTestRecord) string {
+		name := rockRidgeName(record.system_use)
+		if string(record.identifier) != isoName(name) {
+			t.Errorf("ISO9660 name %q does not match Rock Ridge name %q", record.identifier, name)
+		}
+		return name
+	})
+
+	// Joliet root : UCS-2 names, same extents as the primary one
+	svd_root := parseIsoRecord(isoSector(image, 17)[156:])
+	if svd_root.extent == pvd_root.extent {
+		t.Errorf("Joliet and primary roots share extent %d", svd_root.extent)
+	}
+	check("Joliet", parseIsoDirectory(t, image, svd_root), func(record isoTestRecord) string {
+		for name := range by_name {
+			if bytes.Equal(record.identifier, ucs2(name)) {
+				return name
+			}
+		}
+		return string(record.identifier)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A single selector term : key=value, key!=value, key (exists) or !key (absent)
+type Requirement struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+type Selector []Requirement
+
+// ----------------------------------------------------------------------------
+// Parse a comma separated selector, eg. role=db,env!=prod
+// An empty string gives an empty selector, which matches everything
+// ----------------------------------------------------------------------------
+
+func parseSelector(selector string) (Selector, error) {
+	sel := Selector{}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req Requirement
+		if key, value, found := strings.Cut(term, "!="); found {
+			req = Requirement{Key: key, Op: "!=", Value: value}
+		} else if key, value, found := strings.Cut(term, "=="); found {
+			req = Requirement{Key: key, Op: "=", Value: value}
+		} else if key, value, found := strings.Cut(term, "="); found {
+			req = Requirement{Key: key, Op: "=", Value: value}
+		} else if key, found := strings.CutPrefix(term, "!"); found {
+			req = Requirement{Key: key, Op: "!"}
+		} else {
+			req = Requirement{Key: term, Op: "exists"}
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" || strings.ContainsAny(req.Key, "!=") {
+			return nil, fmt.Errorf("Invalid selector term [%s]", term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, found := labels[req.Key]
+		switch req.Op {
+		case "=":
+			if !found || value != req.Value {
+				return false
+			}
+		case "!=":
+			if found && value == req.Value {
+				return false
+			}
+		case "exists":
+			if !found {
+				return false
+			}
+		case "!":
+			if found {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Guest address discovery, for instances getting theirs by DHCP
+// The last address found is recorded in instances/<id>/address
+// Without any IPv4 address, the static IPv6 one is used if there's one
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) guestIP() string {
+	if inst.Config.Network == "bridged" {
+		if address := inst.Config.Address(); address != "" {
+			return address
+		}
+		return inst.ipv6Host()
+	}
+	if ip := inst.Host.discoverIP(inst.Config.MacAddr, inst.Bridge()); ip != "" {
+		if inst.savedIP() != ip {
+			inst.saveIP(ip)
+		}
+		return ip
+	}
+	if ip := inst.savedIP(); ip != "" {
+		return ip
+	}
+	return inst.ipv6Host()
+}
+
+// The last discovered address, ignored unless it is one
+func (inst *Instance) savedIP() string {
+	data, err := os.ReadFile(path.Join(inst.Dir, "address"))
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(data)))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Discovered both with and without sudo : owned by the instance user, but only writable by it
+// Files from older versions were world writable
+func (inst *Instance) saveIP(ip string) {
+	address_file := path.Join(inst.Dir, "address")
+	file, err := os.OpenFile(address_file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_ = file.Chmod(0644)
+	file_chown_to(file, inst.Config.HostUser)
+	_, _ = file.WriteString(ip + "\n")
+}
+
+// Host bridge the instance is plugged into, on Linux
+func (inst *Instance) Bridge() string {
+	if inst.Config.Bridge != "" {
+		return inst.Config.Bridge
+	}
+	return defaultBridge(inst.Config.Network)
+}
+
+func defaultBridge(mode string) string {
+	if mode == "bridged" {
+		return "br0"
+	}
+	return "virbr0" // libvirt's NAT bridge, with its dnsmasq
+}
+
+// Same MAC address, whatever the case and leading zeros (macOS writes 52:54:0:12:34:56)
+func sameMAC(a string, b string) bool {
+	return normalizeMAC(a) != "" && normalizeMAC(a) == normalizeMAC(b)
+}
+
+func normalizeMAC(mac string) string {
+	parts := strings.Split(strings.TrimSpace(mac), ":")
+	if len(parts) != 6 {
+		return ""
+	}
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return ""
+		}
+		parts[i] = fmt.Sprintf("%02x", value)
+	}
+	return strings.Join(parts, ":")
+}
+
+// ----------------------------------------------------------------------------
+// Lease and ARP files parsers, used by host_<os>.go
+// ----------------------------------------------------------------------------
+
+// macOS bootpd leases, blocks of key=value lines between braces
+func leaseFromBootpd(lease_file string, mac string) string {
+	file, err := os.Open(lease_file)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	ip, found := "", ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		switch key {
+		case "{":
+			ip = ""
+		case "ip_address":
+			ip = value
+		case "hw_address":
+			_, hw, _ := strings.Cut(value, ",") // 1,52:54:0:12:34:56
+			if sameMAC(hw, mac) {
+				found = ip // last lease wins, the file grows over time
+			}
+		}
+	}
+	return found
+}
+
+// dnsmasq leases : expiry mac ip hostname client-id
+func leaseFromDnsmasq(lease_file string, mac string) string {
+	file, err := os.Open(lease_file)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	found := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && sameMAC(fields[1], mac) {
+			found = fields[2]
+		}
+	}
+	return found
+}
+
+// libvirt's dnsmasq status file, a JSON array
+func leaseFromLibvirt(status_file string, mac string) string {
+	data, err := os.ReadFile(status_file)
+	if err != nil {
+		return ""
+	}
+	var leases []struct {
+		IP  string `json:"ip-address"`
+		MAC string `json:"mac-address"`
+	}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return ""
+	}
+	found := ""
+	for _, lease := range leases {
+		if sameMAC(lease.MAC, mac) {
+			found = lease.IP
+		}
+	}
+	return found
+}
+
+// ARP table lines holding an IP and a MAC, in whatever order : arp -an or /proc/net/arp
+func leaseFromARP(arp_table string, mac string) string {
+	for _, line := range strings.Split(arp_table, "\n") {
+		ip, hw := "", ""
+		for _, field := range strings.Fields(line) {
+			field = strings.Trim(field, "()")
+			if normalizeMAC(field) != "" {
+				hw = field
+			} else if strings.Count(field, ".") == 3 {
+				ip = field
+			}
+		}
+		if ip != "" && sameMAC(hw, mac) {
+			return ip
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Set once by main : every lock taken by this process is tagged with lockCommand,
+// and lockWait tells whether we block on a busy instance or fail right away
+var lockCommand string
+var lockWait bool
+
+type Lock struct {
+	file *os.File
+}
+
+// ----------------------------------------------------------------------------
+// Advisory locks, one per instance and one per shared resource
+// Lock files live in ./locks so they survive the removal of instances/<id>
+// ----------------------------------------------------------------------------
+
+func lockInstance(id string) (*Lock, error) {
+	return acquireLock("instance-"+id, "instance", lockWait)
+}
+
+// Shared resources guard short critical sections, parallel commands always wait for them
+func lockResource(name string) (*Lock, error) {
+	return acquireLock(name, name, true)
+}
+
+func acquireLock(name string, what string, wait bool) (*Lock, error) {
+	if err := os.MkdirAll("locks", 0777); err != nil {
+		return nil, err
+	}
+	_ = os.Chmod("locks", 0777) // root and the user both take locks
+
+	lock_file := path.Join("locks", name+".lock")
+	file, err := os.OpenFile(lock_file, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Opening lock file %s : %w", lock_file, err)
+	}
+	_ = file.Chmod(0666)
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		owner := lockOwner(lock_file)
+		if !wait {
+			file.Close()
+			return nil, fmt.Errorf("%s busy (%s)", what, owner)
+		}
+		fmt.Printf("Waiting for %s lock (%s)\n", what, owner)
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Locking %s : %w", lock_file, err)
+	}
+
+	// We own the lock, tell others who we are
+	_ = file.Truncate(0)
+	_, _ = file.WriteAt([]byte(fmt.Sprintf("%d %s\n", os.Getpid(), lockCommand)), 0)
+	return &Lock{file: file}, nil
+}
+
+func (lock *Lock) Release() {
+	if lock == nil {
+		return
+	}
+	_ = syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
+
+func lockOwner(lock_file string) string {
+	data, err := os.ReadFile(lock_file)
+	if err != nil {
+		return "unknown owner"
+	}
+	pid, cmd, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if pid == "" {
+		return "unknown owner"
+	}
+	return fmt.Sprintf("pid %s, command %s", pid, cmd)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 )
 
 func fatalf(format string, args ...interface{}) {
@@ -17,31 +18,101 @@ func fatalf(format string, args ...interface{}) {
 // ============================================================================
 
 func main() {
-	var config_file string
-	var err error
-
-	checkRequirements()
+	getHost().checkRequirements()
 
 	parsed, err := parseCommands(os.Args[1:])
 	if err != nil {
 		fatalf("%s\n", err)
 	}
+	lockCommand = parsed.cmd
+	lockWait = parsed.options["wait-lock"].(bool)
+
+	if parsed.target == TargetAll {
+		switch parsed.cmd {
+		case "list":
+			err = List(parsed.options["selector"].(string))
+		case "inventory":
+			err = Inventory(parsed.options["selector"].(string))
+		case "serve":
+			err = Serve(parsed.options["port"].(int), parsed.options["selector"].(string))
+		case "forward":
+			err = ListForwards(parsed.options["selector"].(string))
+		case "hosts":
+			err = SyncHosts(parsed.options["selector"].(string))
+		case "ssh-config":
+			err = SshConfig(parsed.args, parsed.options["selector"].(string))
+		case "cp":
+			err = Copy(parsed.args, parsed.options["recursive"].(bool))
+		case "ssh":
+			// Exits with the remote status, as ssh does
+			code, err := Ssh(parsed.args, parsed.rest, parsed.options["selector"].(string), parsed.options["tty"].(bool))
+			if err != nil {
+				fmt.Println(err)
+			}
+			os.Exit(code)
+		}
+		if err != nil {
+			fatalf("%s", err)
+		}
+		return
+	}
+
+	if parsed.id != "" {
+		if err := runCommand(parsed, parsed.id); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// No id means a --selector, run the command on every matching instance
+	insts, err := selectInstances(parsed.options["selector"].(string))
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if len(insts) == 0 {
+		fatalf("No instance matches selector %s", parsed.options["selector"])
+	}
+	for _, inst := range insts {
+		fmt.Printf("[%s]\n", inst.ID)
+		if err := runCommand(parsed, inst.ID); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Run the parsed command against a single instance
+func runCommand(parsed *ParsedCommand, id string) error {
+	var config_file string
+	var err error
+
+	if parsed.lock {
+		lock, err := lockInstance(id)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
 
 	if parsed.cmd == "create" {
 		config_file = path.Join("config", parsed.options["config"].(string)+".yaml")
 	} else {
-		if file_exists(path.Join("instances", parsed.id)) {
-			config_file = path.Join("instances", parsed.id, "config.yaml")
+		if file_exists(path.Join("instances", id)) {
+			config_file = path.Join("instances", id, "config.yaml")
 		} else {
-			fatalf("No instance named %s", parsed.id)
+			return fmt.Errorf("No instance named %s", id)
 		}
 	}
 
-	inst, err := buildInstance(parsed.id, config_file)
+	inst, err := buildInstance(id, config_file)
 	if err != nil {
-		fatalf("Error : %v", err)
+		return fmt.Errorf("Error : %v", err)
+	}
+
+	if parsed.bridged && inst.Config.needsRoot() && os.Geteuid() != 0 {
+		return fmt.Errorf("sudo is mandatory for command %s unless the instance only uses user and private networks", parsed.cmd)
 	}
 
+	started := time.Now()
 	switch parsed.cmd {
 	case "create":
 		err = inst.Create(parsed.options["force"].(bool))
@@ -57,10 +128,25 @@ func main() {
 		err = inst.Protect()
 	case "shell":
 		err = inst.Shell()
+	case "balloon":
+		err = inst.Balloon(parsed.options["mem"].(int), parsed.options["reclaim"].(bool))
+	case "history":
+		err = inst.History()
 	case "resize":
 		err = inst.Resize()
+	case "forward":
+		err = inst.Forward(parsed.sub, parsed.args)
 	}
-	if err != nil {
-		fmt.Println(err)
+	if err == nil && (parsed.cmd == "create" || parsed.cmd == "destroy") {
+		refreshHosts()
+		if knownErr := writeKnownHosts(); knownErr != nil {
+			fmt.Println(knownErr)
+		}
+	}
+	if parsed.audit {
+		if histErr := inst.recordHistory(parsed, err, time.Since(started)); histErr != nil {
+			fmt.Println(histErr)
+		}
 	}
+	return err
 }
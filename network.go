@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const firstSshPort = 2222
+
+// A guest NIC, as boot.sh and network-config need it
+type Nic struct {
+	Netdev       string // qemu netdev id, net0 for the first one
+	Iface        string // guest interface name
+	Mode         string
+	HostIface    string // bridge on Linux, bridged interface on macOS, the default route one when empty
+	MacAddr      string
+	Addresses    []string // with their prefix, DHCP when empty
+	DefaultRoute bool
+	Gateway      string
+	Mcast        string // multicast group:port of a private network
+}
+
+// ----------------------------------------------------------------------------
+// Where to reach the guest SSH server from the host
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) sshHost() string {
+	if inst.Config.Network == "user" {
+		return "127.0.0.1"
+	}
+	return inst.guestIP()
+}
+
+func (inst *Instance) sshPort() int {
+	if inst.Config.Network == "user" {
+		return inst.Config.SshPort
+	}
+	return 22
+}
+
+func (inst *Instance) sshAddress() string {
+	return net.JoinHostPort(inst.sshHost(), strconv.Itoa(inst.sshPort()))
+}
+
+// ----------------------------------------------------------------------------
+// Instances created before mac_addr was saved only have their MAC in boot.sh,
+// the guest netplan matches it : keep it, as boot.sh is rendered on each start
+// ----------------------------------------------------------------------------
+
+var bootMacAddr = regexp.MustCompile(`mac=([0-9a-fA-F]{2}(?::[0-9a-fA-F]{2}){5})`)
+
+func (inst *Instance) recoverMacAddr() error {
+	if inst.Config.MacAddr != "" {
+		return nil
+	}
+	boot_sh := path.Join(inst.Dir, "boot.sh")
+	data, err := os.ReadFile(boot_sh)
+	if err != nil {
+		return fmt.Errorf("Reading %s : %w", boot_sh, err)
+	}
+	match := bootMacAddr.FindSubmatch(data)
+	if match == nil {
+		return fmt.Errorf("No mac_addr in config.yaml and no MAC address in %s, set mac_addr by hand", boot_sh)
+	}
+	inst.Config.MacAddr = string(match[1])
+	return inst.saveConfig()
+}
+
+// ----------------------------------------------------------------------------
+// Guest NICs : the first one from the top level settings, then the networks list
+// It keeps the default route unless another NIC asks for it
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) nics() []Nic {
+	first := Nic{
+		Netdev:       "net0",
+		Iface:        inst.NetworkConfig.Iface,
+		Mode:         inst.Config.Network,
+		HostIface:    inst.Config.Bridge,
+		MacAddr:      inst.Config.MacAddr,
+		DefaultRoute: true,
+		Gateway:      inst.Config.Gateway,
+	}
+	if inst.Config.Network == "bridged" && inst.Config.Address() != "" {
+		first.Addresses = []string{fmt.Sprintf("%s/%d", inst.Config.Address(), inst.Config.PrefixLen())}
+	}
+	nics := []Nic{first}
+	for i, conf := range inst.Config.Networks {
+		nic := Nic{
+			Netdev:       fmt.Sprintf("net%d", i+1),
+			Iface:        fmt.Sprintf("eth%d", i+1),
+			Mode:         conf.Mode,
+			HostIface:    conf.HostIface,
+			MacAddr:      conf.Mac,
+			DefaultRoute: conf.DefaultRoute,
+			Gateway:      conf.Gateway,
+		}
+		if conf.Mode == "private" {
+			nic.Mcast = privateGroup(conf.Name)
+		}
+		for _, address := range conf.Addresses {
+			if !strings.Contains(address, "/") {
+				address += "/24"
+			}
+			nic.Addresses = append(nic.Addresses, address)
+		}
+		if nic.DefaultRoute {
+			nics[0].DefaultRoute = false
+		}
+		nics = append(nics, nic)
+	}
+	if inst.Host.OS == "linux" {
+		for i := range nics {
+			if nics[i].HostIface == "" && nics[i].Mode != "private" {
+				nics[i].HostIface = defaultBridge(nics[i].Mode)
+			}
+		}
+	}
+	return nics
+}
+
+// ----------------------------------------------------------------------------
+// Pick the network resources of a new instance then write its config.yaml,
+// under the network lock so that parallel creates don't pick the same ones
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) allocateNetwork(write func() error) error {
+	lock, err := lockResource("network")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	if inst.Config.IpAddress == "auto" {
+		if err := inst.allocateIP(); err != nil {
+			return err
+		}
+	}
+	if err := inst.allocatePrivateAddresses(); err != nil {
+		return err
+	}
+	if inst.Config.Network == "user" && inst.Config.SshPort == 0 {
+		others, err := otherConfigs(inst.ID)
+		if err != nil {
+			return err
+		}
+		used := map[int]bool{}
+		for _, conf := range others {
+			used[conf.SshPort] = true
+		}
+		for port := firstSshPort; port < 65536; port++ {
+			if !used[port] && portFree(port) {
+				inst.Config.SshPort = port
+				break
+			}
+		}
+		if inst.Config.SshPort == 0 {
+			return fmt.Errorf("No free port left for SSH")
+		}
+	}
+	return write()
+}
+
+// Lowest address of the host pool that no other instance holds and nobody answers on
+func (inst *Instance) allocateIP() error {
+	if inst.Config.Network != "bridged" {
+		inst.Config.IpAddress = "" // DHCP gives the address
+		return nil
+	}
+	host_config, err := loadHostConfig()
+	if err != nil {
+		return err
+	}
+	if host_config.IpPool == nil {
+		return fmt.Errorf("ip_address is auto but there is no ip_pool in %s", hostConfigFile)
+	}
+	addresses, err := host_config.IpPool.addresses()
+	if err != nil {
+		return err
+	}
+	others, err := otherConfigs(inst.ID)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, conf := range others {
+		used[conf.Address()] = true
+	}
+	for _, address := range addresses {
+		if used[address] {
+			continue
+		}
+		inst.Config.IpAddress = address
+		if free, _ := inst.isIPFree(); free {
+			if inst.Config.Prefix == 0 {
+				inst.Config.IpAddress = address + "/" + host_config.IpPool.prefix()
+			}
+			return nil
+		}
+	}
+	inst.Config.IpAddress = "auto"
+	return fmt.Errorf("No free address left in ip_pool %s", host_config.IpPool.Range)
+}
+
+// Configs of every other instance, including the ones being created
+func otherConfigs(id string) ([]*InstanceConfig, error) {
+	files, err := filepath.Glob(path.Join("instances", "*", "config.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	staging, err := filepath.Glob(path.Join("instances", ".*.staging", "config.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	confs := []*InstanceConfig{}
+	for _, file := range append(files, staging...) {
+		dir := path.Base(path.Dir(file))
+		if dir == id || dir == "."+id+".staging" {
+			continue
+		}
+		conf := buildInstanceConfig()
+		if err := conf.Load(file); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+func portFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
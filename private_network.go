@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Private networks : an L2 segment shared by the instances joining it, made of
+// a qemu socket netdev on a multicast group bound to the loopback, so frames
+// never leave the host
+// ----------------------------------------------------------------------------
+
+// Multicast group and port of a private network, derived from its name so that
+// every instance agrees without any registry
+func privateGroup(name string) string {
+	sum := sha256.Sum256([]byte("ql-private-" + name))
+	port := 20000 + int(binary.BigEndian.Uint16(sum[2:]))%10000
+	return fmt.Sprintf("239.255.%d.%d:%d", sum[0], sum[1], port)
+}
+
+// Give an address to each private NIC without one, when ql.yaml has a subnet for its network
+func (inst *Instance) allocatePrivateAddresses() error {
+	var host_config *HostConfig
+	var others []*InstanceConfig
+	for i := range inst.Config.Networks {
+		nic := &inst.Config.Networks[i]
+		if nic.Mode != "private" || len(nic.Addresses) > 0 {
+			continue
+		}
+		if host_config == nil {
+			var err error
+			if host_config, err = loadHostConfig(); err != nil {
+				return err
+			}
+			if others, err = otherConfigs(inst.ID); err != nil {
+				return err
+			}
+		}
+		private, found := host_config.PrivateNetworks[nic.Name]
+		if !found {
+			continue // the guest addressing is left to the user
+		}
+
+		used := map[string]bool{}
+		for _, conf := range append(others, inst.Config) {
+			for _, other := range conf.Networks {
+				if other.Mode == "private" && other.Name == nic.Name {
+					for _, address := range other.Addresses {
+						ip, _, _ := strings.Cut(address, "/")
+						used[ip] = true
+					}
+				}
+			}
+		}
+		address, err := freeAddress(private.Subnet, used)
+		if err != nil {
+			return fmt.Errorf("Private network %s : %w", nic.Name, err)
+		}
+		nic.Addresses = []string{address}
+	}
+	return nil
+}
+
+// Lowest host address of the subnet not in used, with the subnet prefix
+func freeAddress(subnet string, used map[string]bool) (string, error) {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	first := binary.BigEndian.Uint32(network.IP.To4())
+	last := first | (1<<(bits-ones) - 1)
+	for ip := first + 1; ip < last; ip++ {
+		address := net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).String()
+		if !used[address] {
+			return fmt.Sprintf("%s/%d", address, ones), nil
+		}
+	}
+	return "", fmt.Errorf("No free address left in %s", subnet)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// NoCloud-Net seed server, for instances created with seed_format: net
+// Guests fetch http://<host>:<port>/<id>/<file>, templates being rendered on each
+// request : edit ./templates, reboot the guest and cloud-init runs again
+// ----------------------------------------------------------------------------
+
+func Serve(port int, selector string) error {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return err
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		data, status := seedFile(id, file, sel, r.RemoteAddr)
+		w.WriteHeader(status)
+		_, _ = w.Write(data)
+		fmt.Printf("%s %s %s %s %d %d bytes\n", time.Now().Format("15:04:05"), r.RemoteAddr, id, file, status, len(data))
+	})
+	listen, err := seedListenAddress(sel)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving cloud-init seeds on %s\n", net.JoinHostPort(listen, strconv.Itoa(port)))
+	return http.ListenAndServe(net.JoinHostPort(listen, strconv.Itoa(port)), handler)
+}
+
+// User network guests reach the host loopback through 10.0.2.2 : every interface
+// is only needed when some served instance is on another network
+func seedListenAddress(sel Selector) (string, error) {
+	insts, err := selectInstances("")
+	if err != nil {
+		return "", err
+	}
+	for _, inst := range insts {
+		if inst.Config.SeedFormat == "net" && inst.Config.Network != "user" && sel.Matches(inst.Config.Labels) {
+			return "", nil
+		}
+	}
+	return "127.0.0.1", nil
+}
+
+// The seed holds the server private keys : only the guest itself gets it, from
+// the loopback with a user network, or from its known or discovered address
+func (inst *Instance) seedClient(remote_addr string) bool {
+	host, _, err := net.SplitHostPort(remote_addr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return false
+	}
+	if inst.Config.Network == "user" {
+		return remote.IsLoopback()
+	}
+	guest := net.ParseIP(inst.guestIP())
+	return guest != nil && guest.Equal(remote)
+}
+
+func seedFile(id string, file string, sel Selector, remote_addr string) ([]byte, int) {
+	if !slices.Contains(seedTemplates, file) {
+		return []byte("Not found\n"), http.StatusNotFound
+	}
+	ids, err := listInstances()
+	if err != nil || !slices.Contains(ids, id) {
+		return []byte("Not found\n"), http.StatusNotFound
+	}
+	inst, err := loadInstance(id)
+	if err != nil || inst.Config.SeedFormat != "net" || !sel.Matches(inst.Config.Labels) {
+		return []byte("Not found\n"), http.StatusNotFound
+	}
+	if !inst.seedClient(remote_addr) {
+		return []byte("Forbidden, not the instance address\n"), http.StatusForbidden
+	}
+	inst.prepareNetwork()
+	if err := inst.readSshKeys(); err != nil {
+		return []byte(err.Error() + "\n"), http.StatusInternalServerError
+	}
+
+	files, err := inst.renderSeed()
+	if err != nil {
+		return []byte(err.Error() + "\n"), http.StatusInternalServerError
+	}
+	if file == "meta-data" {
+		// A new instance-id whenever the rest of the seed changes, so that cloud-init runs again
+		hash := sha256.New()
+		for _, seed := range files {
+			if seed.Name != "meta-data" {
+				hash.Write(seed.Data)
+			}
+		}
+		inst.SeedRevision = fmt.Sprintf("%x", hash.Sum(nil))[:12]
+		data, err := inst.render("templates/meta-data")
+		if err != nil {
+			return []byte(err.Error() + "\n"), http.StatusInternalServerError
+		}
+		return data, http.StatusOK
+	}
+	for _, seed := range files {
+		if seed.Name == file {
+			return seed.Data, http.StatusOK
+		}
+	}
+	return []byte("Not found\n"), http.StatusNotFound
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// ----------------------------------------------------------------------------
+// Native SSH client : the user key, or the ones in ssh-agent, to authenticate,
+// and ql's known_hosts keyed by instance id to check the host key
+// ----------------------------------------------------------------------------
+
+func (inst *Instance) sshClient() (*ssh.Client, error) {
+	if inst.sshHost() == "" {
+		return nil, fmt.Errorf("No address known for instance %s, is it running ?", inst.ID)
+	}
+	auth, err := inst.sshAuth()
+	if err != nil {
+		return nil, err
+	}
+	known_hosts, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s : %w", knownHostsFile, err)
+	}
+	config := &ssh.ClientConfig{
+		User: inst.Config.UserName,
+		Auth: auth,
+		HostKeyCallback: func(_ string, remote net.Addr, key ssh.PublicKey) error {
+			return known_hosts(net.JoinHostPort(inst.ID, "22"), remote, key) // as HostKeyAlias does
+		},
+		HostKeyAlgorithms: inst.hostKeyAlgorithms(),
+		Timeout:           5 * time.Second,
+	}
+	client, err := ssh.Dial("tcp", inst.sshAddress(), config)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting %s : %w", inst.sshAddress(), err)
+	}
+	return client, nil
+}
+
+func (inst *Instance) sshAuth() ([]ssh.AuthMethod, error) {
+	signers := []ssh.Signer{}
+	key_file := inst.identityFile()
+	if data, err := os.ReadFile(key_file); key_file != "" && err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		var passphrase_err *ssh.PassphraseMissingError
+		if err == nil {
+			signers = append(signers, signer)
+		} else if !errors.As(err, &passphrase_err) {
+			return nil, fmt.Errorf("Reading user ssh key %s : %w", key_file, err)
+		}
+	}
+	// The agent connection stays open, its signers go through it
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if agent_signers, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agent_signers...)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No usable user key : no ssh_pub_key file with its private key next to it, or a passphrase protected one, and ssh-agent has none")
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
+
+// Only ask for the host key types ql gave the instance, the ones in known_hosts
+func (inst *Instance) hostKeyAlgorithms() []string {
+	algorithms := []string{}
+	for _, key_type := range inst.hostKeyTypes() {
+		switch key_type {
+		case "ed25519":
+			algorithms = append(algorithms, ssh.KeyAlgoED25519)
+		case "ecdsa":
+			algorithms = append(algorithms, ssh.KeyAlgoECDSA256)
+		case "rsa":
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+	}
+	return algorithms
+}
+
+// ----------------------------------------------------------------------------
+// ql ssh <id|glob...> [-- command] - a single instance gets stdin and a PTY
+// when interactive, several ones run the command in parallel, output prefixed
+// Returns the remote exit status, the highest one for several instances
+// ----------------------------------------------------------------------------
+
+func Ssh(patterns []string, command []string, selector string, tty bool) (int, error) {
+	insts, err := matchInstances(patterns, selector)
+	if err != nil {
+		return 1, err
+	}
+	if len(command) == 0 && len(insts) > 1 {
+		return 1, fmt.Errorf("%d instances match, an interactive shell needs a single one", len(insts))
+	}
+	if err := writeKnownHosts(); err != nil {
+		return 1, err
+	}
+	remote := strings.Join(command, " ")
+	if len(insts) == 1 {
+		return insts[0].runSsh(remote, os.Stdin, os.Stdout, os.Stderr, tty)
+	}
+
+	var output sync.Mutex
+	var wait sync.WaitGroup
+	codes := make([]int, len(insts))
+	for i, inst := range insts {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			stdout := &prefixWriter{prefix: "[" + inst.ID + "] ", out: os.Stdout, lock: &output}
+			stderr := &prefixWriter{prefix: "[" + inst.ID + "] ", out: os.Stderr, lock: &output}
+			code, err := inst.runSsh(remote, nil, stdout, stderr, false)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+			}
+			stdout.Flush()
+			stderr.Flush()
+			codes[i] = code
+		}()
+	}
+	wait.Wait()
+	return slices.Max(codes), nil
+}
+
+// Instances whose id is one of the patterns, globs allowed, and matching the selector
+func matchInstances(patterns []string, selector string) ([]*Instance, error) {
+	if len(patterns) == 0 && selector == "" {
+		return nil, fmt.Errorf("Missing instance id, glob or --selector")
+	}
+	insts, err := selectInstances(selector)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*Instance{}
+	for _, inst := range insts {
+		found := len(patterns) == 0
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, inst.ID); ok {
+				found = true
+				break
+			}
+		}
+		if found {
+			matched = append(matched, inst)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("No instance matches %s", strings.Join(patterns, " "))
+	}
+	return matched, nil
+}
+
+func (inst *Instance) runSsh(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer, tty bool) (int, error) {
+	client, err := inst.sshClient()
+	if err != nil {
+		return 255, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return 255, err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	fd := int(os.Stdin.Fd())
+	if stdin != nil && term.IsTerminal(fd) && (tty || command == "") {
+		restore, err := inst.requestPty(session, fd)
+		if err != nil {
+			return 255, err
+		}
+		defer restore()
+	}
+
+	if command == "" {
+		if err = session.Shell(); err == nil {
+			err = session.Wait()
+		}
+	} else {
+		err = session.Run(command)
+	}
+	var exit_err *ssh.ExitError
+	var missing_err *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exit_err):
+		return exit_err.ExitStatus(), nil
+	case errors.As(err, &missing_err):
+		return 255, fmt.Errorf("Connection to %s closed without an exit status", inst.ID)
+	}
+	return 255, err
+}
+
+// A remote PTY the size of the local terminal, which goes raw until restore is called
+func (inst *Instance) requestPty(session *ssh.Session, fd int) (func(), error) {
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	term_name := os.Getenv("TERM")
+	if term_name == "" {
+		term_name = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty(term_name, height, width, modes); err != nil {
+		return nil, fmt.Errorf("Requesting a PTY : %w", err)
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	go func() {
+		for range resized {
+			if width, height, err := term.GetSize(fd); err == nil {
+				_ = session.WindowChange(height, width)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(resized)
+		close(resized)
+		_ = term.Restore(fd, state)
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+// Line based writer, so that parallel outputs don't get mixed within a line
+// ----------------------------------------------------------------------------
+
+type prefixWriter struct {
+	prefix  string
+	out     io.Writer
+	lock    *sync.Mutex
+	pending []byte
+}
+
+func (writer *prefixWriter) Write(data []byte) (int, error) {
+	writer.pending = append(writer.pending, data...)
+	for {
+		end := bytes.IndexByte(writer.pending, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		writer.emit(writer.pending[:end+1])
+		writer.pending = writer.pending[end+1:]
+	}
+}
+
+func (writer *prefixWriter) Flush() {
+	if len(writer.pending) > 0 {
+		writer.emit(append(writer.pending, '\n'))
+		writer.pending = nil
+	}
+}
+
+func (writer *prefixWriter) emit(line []byte) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	_, _ = writer.out.Write(append([]byte(writer.prefix), line...))
+}
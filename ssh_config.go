@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const knownHostsFile = "keys/known_hosts"
+
+// ----------------------------------------------------------------------------
+// ql ssh-config [id...] - OpenSSH Host blocks, to be Included from ~/.ssh/config
+// so that ssh, scp, VS Code Remote or Ansible reach instances by their id
+// ----------------------------------------------------------------------------
+
+func SshConfig(ids []string, selector string) error {
+	insts, err := selectInstances(selector)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		by_id := map[string]*Instance{}
+		for _, inst := range insts {
+			by_id[inst.ID] = inst
+		}
+		insts = []*Instance{}
+		for _, id := range ids {
+			inst, found := by_id[id]
+			if !found {
+				return fmt.Errorf("No instance named %s", id)
+			}
+			insts = append(insts, inst)
+		}
+	}
+	if err := writeKnownHosts(); err != nil {
+		return err
+	}
+	known_hosts, err := filepath.Abs(knownHostsFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("# Generated by ql ssh-config")
+	for _, inst := range insts {
+		host := inst.sshHost()
+		if host == "" {
+			fmt.Printf("\n# %s : no address known yet\n", inst.ID)
+			continue
+		}
+		fmt.Printf("\nHost %s\n", inst.ID)
+		fmt.Printf("  HostName %s\n", host)
+		if inst.sshPort() != 22 {
+			fmt.Printf("  Port %d\n", inst.sshPort())
+		}
+		fmt.Printf("  User %s\n", inst.Config.UserName)
+		if identity_file := inst.identityFile(); identity_file != "" {
+			fmt.Printf("  IdentityFile %s\n", identity_file)
+		}
+		fmt.Printf("  UserKnownHostsFile %s\n", known_hosts)
+		fmt.Printf("  HostKeyAlias %s\n", inst.ID)
+	}
+	return nil
+}
+
+// The user private key, next to the first public key file given in the config
+// Empty with only inline or agent keys, ssh-agent is then the way in
+func (inst *Instance) identityFile() string {
+	files := inst.Config.SshPubKey.files()
+	if len(files) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(files[0], ".pub")
+}
+
+// ----------------------------------------------------------------------------
+// ql's own known_hosts, one line per instance keyed by its id, to be used with
+// HostKeyAlias : whatever the address, the host key is checked against the instance one
+// ----------------------------------------------------------------------------
+
+func writeKnownHosts() error {
+	ids, err := listInstances()
+	if err != nil {
+		return err
+	}
+	lock, err := lockResource("keys")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	// A broken instance only loses its lines, the others stay reachable
+	lines := []string{}
+	for _, id := range ids {
+		inst, err := loadInstance(id)
+		var keys []string
+		if err == nil {
+			keys, err = inst.hostPublicKeys()
+		}
+		if err != nil {
+			fmt.Printf("Skipping %s in %s : %s\n", id, knownHostsFile, err)
+			continue
+		}
+		for _, key := range keys {
+			lines = append(lines, inst.ID+" "+key)
+		}
+	}
+	if err := os.MkdirAll("keys", 0755); err != nil {
+		return err
+	}
+
+	// Replaced at once, ssh and ql shell never read a partial file
+	file, err := os.CreateTemp("keys", "known_hosts.*")
+	if err != nil {
+		return fmt.Errorf("Writing %s : %w", knownHostsFile, err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	file_chown_to(file, hostUser())
+	if close_err := file.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), knownHostsFile)
+	}
+	if err != nil {
+		return fmt.Errorf("Writing %s : %w", knownHostsFile, err)
+	}
+	return nil
+}
+
+// Public host keys the instance presents, in authorized_keys format
+func (inst *Instance) hostPublicKeys() ([]string, error) {
+	keys := []string{}
+	for _, key_type := range inst.hostKeyTypes() {
+		key_file := inst.hostKeyFile(key_type) + ".pub"
+		data, err := os.ReadFile(key_file)
+		if err != nil {
+			return nil, fmt.Errorf("Reading server public ssh key %s : %w", key_file, err)
+		}
+		keys = append(keys, strings.TrimSpace(string(data)))
+	}
+	return keys, nil
+}
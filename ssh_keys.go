@@ -1,28 +1,58 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/yaml.v3"
 )
 
-func generateRSAKeys(key_pub *[]byte, key_private *[]byte, bitSize int) error {
-	key, err := rsa.GenerateKey(rand.Reader, bitSize)
+// Host key types of new instances, RSA is slow to generate and disabled by hardening roles
+var defaultHostKeyTypes = []string{"ed25519", "ecdsa"}
+
+type ServerKey struct {
+	Type    string // as in cloud-init ssh_keys : rsa, ecdsa or ed25519
+	Private string
+	Public  string
+}
+
+// Generate a host key pair, the private key in OpenSSH format and the public one in authorized_keys format
+func generateHostKeys(key_type string, key_pub *[]byte, key_private *[]byte) error {
+	var key crypto.Signer
+	var err error
+	switch key_type {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return fmt.Errorf("Unknown host key type %s", key_type)
+	}
 	if err != nil {
 		return err
 	}
 
-	*key_private = pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(key),
-		},
-	)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return err
+	}
+	*key_private = pem.EncodeToMemory(block)
 
-	pubKey, err := ssh.NewPublicKey(&key.PublicKey)
+	pubKey, err := ssh.NewPublicKey(key.Public())
 	if err != nil {
 		return err
 	}
@@ -31,3 +61,139 @@ func generateRSAKeys(key_pub *[]byte, key_private *[]byte, bitSize int) error {
 
 	return nil
 }
+
+// ----------------------------------------------------------------------------
+// ssh_pub_key : a single entry or a list of them, each one a public key file
+// relative to $HOME, an inline key, or agent for the keys loaded in ssh-agent
+// ----------------------------------------------------------------------------
+
+type SshPubKeys []string
+
+func (keys *SshPubKeys) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*keys = SshPubKeys{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*keys = list
+	return nil
+}
+
+// A single entry stays a plain value, as in configs written before lists were allowed
+func (keys SshPubKeys) MarshalYAML() (interface{}, error) {
+	if len(keys) == 1 {
+		return keys[0], nil
+	}
+	return []string(keys), nil
+}
+
+func isInlineKey(entry string) bool {
+	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+	return err == nil
+}
+
+// Key files, the first one gives the private key ql connects with
+func (keys SshPubKeys) files() []string {
+	home, _ := os.UserHomeDir()
+	files := []string{}
+	for _, entry := range keys {
+		if entry != "agent" && !isInlineKey(entry) {
+			files = append(files, path.Join(home, entry))
+		}
+	}
+	return files
+}
+
+// Every public key to authorize, in authorized_keys format
+func (keys SshPubKeys) authorizedKeys() ([]string, error) {
+	home, _ := os.UserHomeDir()
+	authorized := []string{}
+	for _, entry := range keys {
+		switch {
+		case entry == "agent":
+			agent_keys, err := agentKeys()
+			if err != nil {
+				return nil, err
+			}
+			authorized = append(authorized, agent_keys...)
+		case isInlineKey(entry):
+			authorized = append(authorized, strings.TrimSpace(entry))
+		default:
+			key_file := path.Join(home, entry)
+			data, err := os.ReadFile(key_file)
+			if err != nil {
+				return nil, fmt.Errorf("Reading user public ssh key %s : %w", key_file, err)
+			}
+			// May hold several keys, as an authorized_keys file does
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				if !isInlineKey(line) {
+					return nil, fmt.Errorf("%s is not a public ssh key file", key_file)
+				}
+				authorized = append(authorized, line)
+			}
+		}
+	}
+	return authorized, nil
+}
+
+// The user keys resolved at creation, kept next to config.yaml
+func (inst *Instance) authorizedKeysFile() string {
+	return path.Join(inst.Dir, "authorized_keys")
+}
+
+func (inst *Instance) saveAuthorizedKeys() error {
+	keys, err := inst.Config.SshPubKey.authorizedKeys()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(inst.authorizedKeysFile(), []byte(strings.Join(keys, "\n")+"\n"), 0644)
+}
+
+// Instances created before authorized_keys was saved still resolve ssh_pub_key
+func (inst *Instance) authorizedKeys() ([]string, error) {
+	data, err := os.ReadFile(inst.authorizedKeysFile())
+	if os.IsNotExist(err) {
+		return inst.Config.SshPubKey.authorizedKeys()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s : %w", inst.authorizedKeysFile(), err)
+	}
+	keys := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys, nil
+}
+
+func agentKeys() ([]string, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("ssh_pub_key has agent but SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting ssh-agent : %w", err)
+	}
+	defer conn.Close()
+	agent_keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("Listing ssh-agent keys : %w", err)
+	}
+	if len(agent_keys) == 0 {
+		return nil, fmt.Errorf("ssh_pub_key has agent but ssh-agent holds no key")
+	}
+	keys := []string{}
+	for _, key := range agent_keys {
+		keys = append(keys, key.String())
+	}
+	return keys, nil
+}
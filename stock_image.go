@@ -38,7 +38,7 @@ func buildStockImage(image_name string) *StockImage {
 func (image *StockImage) setInfo() {
 	info := ArchInfo{}
 	os_match := regexp.MustCompile("alpine|debian")
-	arch_match := regexp.MustCompile("arm64|aarch64")
+	arch_match := regexp.MustCompile("arm64|aarch64|amd64|x86_64")
 	version_match := regexp.MustCompile(`\A[\d+\.]+`)
 	for _, segment := range strings.Split(image.Name, "-") {
 		switch {
@@ -84,6 +84,12 @@ func (image *StockImage) setURL() {
 // ----------------------------------------------------------------------------
 
 func (image *StockImage) download() error {
+	lock, err := lockResource("downloads")
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
 	dst := path.Join("downloads", image.Name+".qcow2")
 	if err := DownloadFile(dst, image.URL); err != nil {
 		return fmt.Errorf("download failed : %w", err)
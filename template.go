@@ -1,29 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"text/template"
 )
 
 func (inst *Instance) render_template(template_file string, dst_filename string) error {
-	data, err := os.ReadFile(template_file)
+	data, err := inst.render(template_file)
 	if err != nil {
-		return fmt.Errorf("Template error : %w", err)
+		return err
 	}
-	tmpl, err := template.New("void").Parse(string(data))
-	if err != nil {
+	if err := os.WriteFile(dst_filename, data, 0644); err != nil {
 		return fmt.Errorf("Template error : %w", err)
 	}
-	file, err := os.OpenFile(dst_filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	return nil
+}
+
+// Render a template in memory
+func (inst *Instance) render(template_file string) ([]byte, error) {
+	data, err := os.ReadFile(template_file)
 	if err != nil {
-		return fmt.Errorf("Template error : %w", err)
+		return nil, fmt.Errorf("Template error : %w", err)
 	}
-	err = tmpl.Execute(file, inst)
+	tmpl, err := template.New("void").Parse(string(data))
 	if err != nil {
-		file.Close()
-		return fmt.Errorf("Template error : %w", err)
+		return nil, fmt.Errorf("Template error : %w", err)
 	}
-	file.Close()
-	return nil
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, inst); err != nil {
+		return nil, fmt.Errorf("Template error : %w", err)
+	}
+	return out.Bytes(), nil
 }
@@ -3,16 +3,63 @@
 # -virtfs local,path=/Users/chris/qemu_shared,mount_tag=mount_tag,security_model=passthrough \
 # sudo mount -t 9p -o trans=virtio mount_tag ./host -oversion=9p2000.L
 # -virtfs local,path=/Users/chris/qemu_shared,mount_tag=mount_tag,security_model=mapped-xattr,fmode=0666,dmode=0777 \
+{{- if eq .Config.Network "user" }}
+host_ip=10.0.2.2;
+run_with="";
+[ "$(id -u)" = 0 ] && run_with="-run-with user={{ .Config.HostUser }}";
+{{- else if eq .Host.OS "darwin" }}
 iface=$(route get default | grep interface | awk '{print $2}');
-qemu-system-aarch64 -M virt \
-{{ if not .Config.EnableVirtFS }}-run-with user={{ .Config.HostUser }}{{ end }} \
-{{ if .Config.EnableVirtFS }}-virtfs local,path=./share,mount_tag=mount_tag,security_model=mapped-xattr,fmode=0666,dmode=0777 \{{ end }}
--accel hvf \
--smp {{ .Config.Smp }} -m {{ .Config.Mem }}G -cpu host \
+{{- if eq .Config.SeedFormat "net" }}
+host_ip=$(ipconfig getifaddr $iface);
+{{- end }}
+{{- else if eq .Config.SeedFormat "net" }}
+host_ip=$(ip -4 -o addr show dev {{ .Bridge }} | awk '{print $4}' | cut -d/ -f1);
+{{- end }}
+qemu-system-{{ .Host.Arch }} -M {{ .Host.Machine }} \
+{{- if and (not .Config.EnableVirtFS) (eq .Config.Network "user") }}
+$run_with \
+{{- else if not .Config.EnableVirtFS }}
+-run-with user={{ .Config.HostUser }} \
+{{- else }}
+-virtfs local,path=./share,mount_tag=mount_tag,security_model=mapped-xattr,fmode=0666,dmode=0777 \
+{{- end }}
+-accel {{ .Host.Accel }} \
+-smp {{ .Config.Smp }} -m {{ .Config.Mem }}G -cpu {{ .Host.Cpu }} \
 -bios bios.fd \
+-device virtio-balloon-pci,id=balloon0{{ if .Config.MemMin }},deflate-on-oom=on,free-page-reporting=on{{ end }} \
 -hda boot.qcow2 \
+{{- if eq .Config.Network "user" }}
+-netdev user,id=net0,hostfwd=tcp:127.0.0.1:{{ .Config.SshPort }}-:22{{ range .Forwards }},hostfwd={{ .Hostfwd }}{{ end }} \
+-device virtio-net-pci,netdev=net0,mac={{ .NetworkConfig.MacAddr }} \
+{{- else if and (eq .Host.OS "darwin") (eq .Config.Network "bridged") }}
 -nic vmnet-bridged,ifname=$iface,mac={{ .NetworkConfig.MacAddr }} \
+{{- else if eq .Host.OS "darwin" }}
+-nic vmnet-{{ .Config.Network }},mac={{ .NetworkConfig.MacAddr }} \
+{{- else }}
+-nic bridge,br={{ .Bridge }},model=virtio-net-pci,mac={{ .NetworkConfig.MacAddr }} \
+{{- end }}
+{{- range slice .NetworkConfig.Nics 1 }}
+{{- if eq .Mode "private" }}
+-netdev socket,id={{ .Netdev }},mcast={{ .Mcast }},localaddr=127.0.0.1 \
+-device virtio-net-pci,netdev={{ .Netdev }},mac={{ .MacAddr }} \
+{{- else if eq .Mode "user" }}
+-netdev user,id={{ .Netdev }} \
+-device virtio-net-pci,netdev={{ .Netdev }},mac={{ .MacAddr }} \
+{{- else if and (eq $.Host.OS "darwin") (eq .Mode "bridged") }}
+-nic vmnet-bridged,ifname={{ if .HostIface }}{{ .HostIface }}{{ else }}$(route get default | grep interface | awk '{print $2}'){{ end }},mac={{ .MacAddr }} \
+{{- else if eq $.Host.OS "darwin" }}
+-nic vmnet-{{ .Mode }},mac={{ .MacAddr }} \
+{{- else }}
+-nic bridge,br={{ .HostIface }},model=virtio-net-pci,mac={{ .MacAddr }} \
+{{- end }}
+{{- end }}
+{{- if eq .Config.SeedFormat "net" }}
+-smbios "type=1,serial=ds=nocloud-net;s=http://$host_ip:{{ .Config.SeedPort }}/{{ .ID }}/" \
+{{- else if eq .Config.SeedFormat "vfat" }}
+-drive file=cidata.img,format=raw,if=virtio,readonly=on \
+{{- else }}
 -cdrom cidata.iso \
+{{- end }}
 -qmp unix:./qemu-monitor,server,nowait \
 -serial mon:stdio \
 -nographic
@@ -4,10 +4,10 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
-	"net"
 	"os"
-	"os/exec"
+	"os/user"
 	"runtime"
+	"strconv"
 )
 
 // func pp(args ...interface{}) {
@@ -25,32 +25,6 @@ func qemuArch() string {
 	return arch
 }
 
-func checkRequirements() {
-	arch := qemuArch()
-
-	reqs := []struct {
-		k string
-		t int
-	}{
-		{k: fmt.Sprintf("qemu-system-%s", arch), t: 1},
-		{k: "qemu-img", t: 1},
-		{k: "hdiutil", t: 1},
-		{k: "route", t: 1},
-		{k: "awk", t: 1},
-		{k: fmt.Sprintf("/opt/local/share/qemu/edk2-%s-code.fd", arch), t: 0},
-	}
-	for _, r := range reqs {
-		if r.t == 0 && !file_exists(r.k) {
-			fatalf("Missing file %s", r.k)
-		}
-		if r.t == 1 {
-			if path, _ := exec.LookPath(r.k); len(path) == 0 {
-				fatalf("Executable %s not found in PATH", r.k)
-			}
-		}
-	}
-}
-
 func genMACAddr() (string, error) {
 	mac := make([]byte, 6)
 	_, err := rand.Read(mac)
@@ -64,21 +38,6 @@ func genMACAddr() (string, error) {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]), nil
 }
 
-func IPv4ToIPv6(ipv4Str string) (string, error) {
-	ipv4 := net.ParseIP(ipv4Str)
-	if ipv4 == nil {
-		return "", fmt.Errorf("invalid IPv4 address: %s", ipv4Str)
-	}
-
-	ipv6 := net.IPv6zero
-	ipv6 = ipv6.To16() // Ensure it is 128 bits
-	ipv4 = ipv4.To4()  // Ensure it is 32 bits
-
-	copy(ipv6[12:], ipv4)
-
-	return ipv6.String(), nil
-}
-
 // ============================================================================
 // File utilities
 // ============================================================================
@@ -112,3 +71,15 @@ func file_cp(src, dst string) (int64, error) {
 	nBytes, err := io.Copy(destination, source)
 	return nBytes, err
 }
+
+// Files written both with and without sudo stay owned by the user, when running as root
+func file_chown_to(file *os.File, user_name string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if owner, err := user.Lookup(user_name); err == nil {
+		uid, _ := strconv.Atoi(owner.Uid)
+		gid, _ := strconv.Atoi(owner.Gid)
+		_ = file.Chown(uid, gid)
+	}
+}